@@ -0,0 +1,97 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ExtraMount is an additional host path to bind into containers that are
+// allocated a specific card.
+type ExtraMount struct {
+	HostPath      string `json:"hostPath"`
+	ContainerPath string `json:"containerPath"`
+	ReadOnly      bool   `json:"readOnly"`
+}
+
+// AllocExtras describes operator supplied customizations applied during
+// Allocate for one card, keyed by its serial number. This gives clusters
+// with heterogeneous hardware (e.g. a card wired to special peripherals)
+// a hook to adjust allocation without code changes.
+type AllocExtras struct {
+	Envs   map[string]string `json:"envs"`
+	Mounts []ExtraMount      `json:"mounts"`
+}
+
+// allocExtras maps serial number to the extras for that card. Empty when
+// no mapping file is configured.
+var allocExtras = make(map[string]AllocExtras)
+
+// loadAllocExtras reads and validates the serial number to extras
+// mapping file. Invalid entries fail the load as a whole so a typo does
+// not silently drop customizations.
+func loadAllocExtras(fname string) error {
+	buf, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return fmt.Errorf("Can't read alloc config %s: %v", fname, err)
+	}
+	extras := make(map[string]AllocExtras)
+	if err := json.Unmarshal(buf, &extras); err != nil {
+		return fmt.Errorf("Can't parse alloc config %s: %v", fname, err)
+	}
+	for sn, extra := range extras {
+		if sn == "" {
+			return fmt.Errorf("alloc config %s: empty serial number key", fname)
+		}
+		for env := range extra.Envs {
+			if env == "" {
+				return fmt.Errorf("alloc config %s: empty env name for serial %s", fname, sn)
+			}
+		}
+		for _, mount := range extra.Mounts {
+			if !strings.HasPrefix(mount.HostPath, "/") ||
+				!strings.HasPrefix(mount.ContainerPath, "/") {
+				return fmt.Errorf("alloc config %s: mount paths for serial %s must be absolute",
+					fname, sn)
+			}
+		}
+	}
+	allocExtras = extras
+	return nil
+}
+
+// warnUnknownAllocExtras logs serials from the mapping file that don't
+// match any discovered card, so stale entries are visible to operators.
+// Unknown entries are otherwise ignored.
+func warnUnknownAllocExtras(devices map[string]map[string]Device) {
+	for sn := range allocExtras {
+		found := false
+		for _, subMap := range devices {
+			if _, ok := subMap[sn]; ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Warnf("alloc config entry for serial %s matches no discovered card", sn)
+		}
+	}
+}
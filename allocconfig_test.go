@@ -0,0 +1,96 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func writeAllocConfig(t *testing.T, content string) string {
+	t.Helper()
+	fname := path.Join(t.TempDir(), "alloc.json")
+	if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func TestLoadAllocExtras(t *testing.T) {
+	defer func() { allocExtras = make(map[string]AllocExtras) }()
+
+	fname := writeAllocConfig(t, `{
+		"serialA": {
+			"envs": {"SPECIAL_PERIPHERAL": "1"},
+			"mounts": [{"hostPath": "/dev/ttyUSB0", "containerPath": "/dev/ttyUSB0"}]
+		}
+	}`)
+	if err := loadAllocExtras(fname); err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+	extra, ok := allocExtras["serialA"]
+	if !ok {
+		t.Fatalf("mapping not loaded: %v", allocExtras)
+	}
+	if extra.Envs["SPECIAL_PERIPHERAL"] != "1" {
+		t.Errorf("envs = %v", extra.Envs)
+	}
+	if len(extra.Mounts) != 1 || extra.Mounts[0].HostPath != "/dev/ttyUSB0" {
+		t.Errorf("mounts = %v", extra.Mounts)
+	}
+}
+
+func TestLoadAllocExtrasRejections(t *testing.T) {
+	defer func() { allocExtras = make(map[string]AllocExtras) }()
+
+	cases := []struct {
+		name    string
+		content string
+	}{
+		{"malformed JSON", `{"serialA": `},
+		{"empty serial key", `{"": {"envs": {"A": "1"}}}`},
+		{"empty env name", `{"serialA": {"envs": {"": "1"}}}`},
+		{"relative host path", `{"serialA": {"mounts": [{"hostPath": "dev/x", "containerPath": "/dev/x"}]}}`},
+		{"relative container path", `{"serialA": {"mounts": [{"hostPath": "/dev/x", "containerPath": "dev/x"}]}}`},
+	}
+	for _, c := range cases {
+		if err := loadAllocExtras(writeAllocConfig(t, c.content)); err == nil {
+			t.Errorf("%s: load succeeded", c.name)
+		}
+	}
+	if err := loadAllocExtras(path.Join(t.TempDir(), "absent.json")); err == nil {
+		t.Error("missing file: load succeeded")
+	}
+}
+
+// A failed load keeps the previous mapping intact; reloadConfig relies
+// on this to survive a bad edit without dropping customizations.
+func TestLoadAllocExtrasKeepsOldOnError(t *testing.T) {
+	defer func() { allocExtras = make(map[string]AllocExtras) }()
+
+	good := writeAllocConfig(t, `{"serialA": {"envs": {"A": "1"}}}`)
+	if err := loadAllocExtras(good); err != nil {
+		t.Fatal(err)
+	}
+	bad := writeAllocConfig(t, `{"serialB": {"envs": {"": "1"}}}`)
+	if err := loadAllocExtras(bad); err == nil {
+		t.Fatal("invalid reload succeeded")
+	}
+	if _, ok := allocExtras["serialA"]; !ok || len(allocExtras) != 1 {
+		t.Errorf("failed reload changed the mapping: %v", allocExtras)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The v1beta1 device plugin API has no per-device attributes in
+// ListAndWatch, so curated discovery values are exposed as container
+// annotations on the Allocate response instead, where downstream
+// controllers can read them. The set is configurable to bound
+// annotation cardinality.
+
+const attrAnnotationPrefix = "fpga.xilinx.com/"
+
+// deviceAttributes is the curated set of attribute names attached
+// during Allocate. Empty disables attribute annotations.
+var deviceAttributes []string
+
+// deviceAttribute returns the raw value of the named attribute for d,
+// or empty when the card doesn't have it.
+func deviceAttribute(d Device, name string) string {
+	switch name {
+	case "serial":
+		return d.sn
+	case "shell":
+		return d.shellVer
+	case "timestamp":
+		return d.timestamp
+	case "xclbin_uuid":
+		return d.xclbinUUID
+	case "clock_freqs":
+		return d.clockFreqs
+	case "dbdf":
+		var dbdfs []string
+		for _, node := range d.Nodes {
+			dbdfs = append(dbdfs, node.DBDF)
+		}
+		return strings.Join(dbdfs, ",")
+	}
+	return ""
+}
+
+// parseDeviceAttributes validates the comma separated attribute list
+// from the command line against the known attribute names.
+func parseDeviceAttributes(list string) ([]string, error) {
+	var attrs []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		switch name {
+		case "serial", "shell", "timestamp", "xclbin_uuid", "dbdf", "clock_freqs":
+			attrs = append(attrs, name)
+		default:
+			return nil, fmt.Errorf("unknown device attribute %q", name)
+		}
+	}
+	return attrs, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+// AWS F1 exposes one application PF (device 0x1042) per FPGA slot, plus
+// a management PF (0x1041) that must not be handed to pods. The xdma
+// driver creates /dev/xdma<slot>_* nodes and an /dev/fpga<slot>
+// management node per slot.
+const (
+	AWSF1MgmtDevID = "0x1041"
+	AWSF1UserDevID = "0x1042"
+	AWSF1ShellVer  = "aws_f1_xdma"
+)
+
+// awsDevRoot is /dev, or the host /dev mount when -dev-root is set.
+var awsDevRoot = "/dev"
+
+// getF1SlotNodes returns the device nodes under devDir belonging to one
+// F1 slot, and only that slot, so pods on the same instance stay
+// isolated from each other's slots.
+func getF1SlotNodes(devDir string, slot int) []string {
+	var nodes []string
+	files, err := ioutil.ReadDir(devDir)
+	if err != nil {
+		return nodes
+	}
+	xdmaPrefix := fmt.Sprintf("xdma%d_", slot)
+	fpgaNode := fmt.Sprintf("fpga%d", slot)
+	for _, file := range files {
+		fname := file.Name()
+		if strings.HasPrefix(fname, xdmaPrefix) || fname == fpgaNode {
+			nodes = append(nodes, path.Join(devDir, fname))
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// getAFIID returns the id of the AFI loaded on the slot's PF, empty
+// when the driver doesn't expose one or no AFI is loaded.
+func getAFIID(pciID string) string {
+	devDir := locator.DeviceDir(pciID)
+	for _, attr := range []string{"agfi_id", "afi_id"} {
+		content, err := GetFileContent(path.Join(devDir, attr))
+		if err != nil || content == "" || content == "none" {
+			continue
+		}
+		return content
+	}
+	return ""
+}
+
+// getAWSF1Device builds the Device for one F1 slot. F1 has no XMC/ROM
+// sysfs, so the identity is derived from the loaded AFI when the driver
+// exposes it, else from the slot and DBDF.
+func getAWSF1Device(pciID string, slot int) Device {
+	topo := getTopology(pciID)
+	node := Node{
+		DBDF:         pciID,
+		AWSSlot:      strconv.Itoa(slot),
+		SubdevNodes:  getF1SlotNodes(awsDevRoot, slot),
+		NUMA:         topo.NUMANode,
+		ParentSwitch: topo.ParentSwitch,
+	}
+	afi := getAFIID(pciID)
+	id := pciID
+	if afi != "" {
+		id = afi
+	}
+	return Device{
+		sn:       fmt.Sprintf("aws-f1-slot%d-%s", slot, id),
+		shellVer: AWSF1ShellVer,
+		// the loaded AFI plays the role the xclbin UUID has on-prem
+		xclbinUUID: afi,
+		timestamp:  "0",
+		Healthy:    pluginapi.Healthy,
+		Nodes:      []Node{node},
+	}
+}
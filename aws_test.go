@@ -0,0 +1,147 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestGetF1SlotNodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f1dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a simulated 2-slot F1 instance, plus unrelated nodes
+	for _, fname := range []string{
+		"xdma0_h2c_0", "xdma0_c2h_0", "xdma0_user", "fpga0",
+		"xdma1_h2c_0", "xdma1_c2h_0", "xdma1_user", "fpga1",
+		"xdma10_h2c_0", "fpga10",
+		"null", "urandom",
+	} {
+		if err := ioutil.WriteFile(path.Join(dir, fname), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nodes := getF1SlotNodes(dir, 0)
+	if len(nodes) != 4 {
+		t.Fatalf("slot 0: expected 4 nodes, got %v", nodes)
+	}
+	for _, node := range nodes {
+		base := path.Base(node)
+		// slot 1 and slot 10 nodes must never leak into slot 0
+		if !strings.HasPrefix(base, "xdma0_") && base != "fpga0" {
+			t.Errorf("slot 0: foreign node %s", node)
+		}
+	}
+
+	if nodes := getF1SlotNodes(dir, 1); len(nodes) != 4 {
+		t.Errorf("slot 1: expected 4 nodes, got %v", nodes)
+	}
+	if nodes := getF1SlotNodes(dir, 2); len(nodes) != 0 {
+		t.Errorf("slot 2: expected no nodes, got %v", nodes)
+	}
+}
+
+func TestGetAWSF1Device(t *testing.T) {
+	device := getAWSF1Device("0000:00:1d.0", 3)
+	if device.shellVer != AWSF1ShellVer {
+		t.Errorf("wrong shell version %s", device.shellVer)
+	}
+	// no AFI attribute visible: the identity falls back to slot + DBDF
+	if device.sn != "aws-f1-slot3-0000:00:1d.0" {
+		t.Errorf("wrong serial %q", device.sn)
+	}
+	if len(device.Nodes) != 1 {
+		t.Fatalf("expected 1 node, got %d", len(device.Nodes))
+	}
+	if device.Nodes[0].AWSSlot != "3" {
+		t.Errorf("wrong slot %q", device.Nodes[0].AWSSlot)
+	}
+	if device.Nodes[0].DBDF != "0000:00:1d.0" {
+		t.Errorf("wrong DBDF %q", device.Nodes[0].DBDF)
+	}
+}
+
+func TestGetAWSF1DeviceAFIIdentity(t *testing.T) {
+	defer func() { locator = pciLocator{root: SysfsDevices} }()
+
+	root, err := ioutil.TempDir("", "pci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	devDir := path.Join(root, "0000:00:1d.0")
+	if err := os.MkdirAll(devDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(devDir, "agfi_id"), []byte("agfi-0123456789abcdef0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	locator = pciLocator{root: root}
+
+	device := getAWSF1Device("0000:00:1d.0", 0)
+	if device.sn != "aws-f1-slot0-agfi-0123456789abcdef0" {
+		t.Errorf("wrong serial %q", device.sn)
+	}
+	if device.xclbinUUID != "agfi-0123456789abcdef0" {
+		t.Errorf("AFI id not recorded as loaded image: %q", device.xclbinUUID)
+	}
+}
+
+func TestGetDevicesAWSF1(t *testing.T) {
+	defer func() {
+		fsys = osFS{}
+		locator = pciLocator{root: SysfsDevices}
+	}()
+	const root = "/sys/bus/pci/devices"
+	// an F1 instance shows the mgmt PF, the application PF and an ENA
+	// NIC, all under the AWS vendor id; only the application PF becomes
+	// a slot
+	fsys = memFS{files: map[string]string{
+		path.Join(root, "0000:00:1c.0", VendorFile): AWS_ID + "\n",
+		path.Join(root, "0000:00:1c.0", DeviceFile): AWSF1MgmtDevID + "\n",
+		path.Join(root, "0000:00:1d.0", VendorFile): AWS_ID + "\n",
+		path.Join(root, "0000:00:1d.0", DeviceFile): AWSF1UserDevID + "\n",
+		path.Join(root, "0000:00:05.0", VendorFile): AWS_ID + "\n",
+		path.Join(root, "0000:00:05.0", DeviceFile): "0xec20\n",
+	}}
+	locator = pciLocator{root: root}
+
+	devices, diags, err := GetDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diags) != 0 {
+		t.Errorf("unexpected diagnostics %v", diags)
+	}
+	if len(devices) != 1 {
+		t.Fatalf("devices = %v, want one F1 slot", devices)
+	}
+	device, ok := devices["aws-f1-slot0-0000:00:1d.0"]
+	if !ok {
+		t.Fatalf("F1 slot keyed unexpectedly: %v", devices)
+	}
+	if device.shellVer != AWSF1ShellVer {
+		t.Errorf("shell = %q", device.shellVer)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path"
+	"strings"
+	"sync"
+
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+// devCache holds the last full scan, keyed by a fingerprint of the PCI
+// IDs present. Polls between hotplug events skip the full metadata walk
+// and only re-grade health, which changes much faster than presence.
+var devCache struct {
+	sync.Mutex
+	fingerprint string
+	devices     map[string]Device
+	diags       []DeviceError
+}
+
+// refreshHealth re-evaluates the sensor-driven part of a cached
+// device's state. Unhealthy has several causes and only the one the
+// sensors created is theirs to clear: a card whose shell is still
+// initializing stays withheld until ready reads 0x1, and an
+// -expected-shell mismatch stays withheld for good, since the running
+// shell can only change with a full rescan. Degraded markers derived
+// from configuration (VBNV mismatch) are likewise left alone.
+func refreshHealth(device Device) Device {
+	status := runHealthCheckers(&device)
+	if status == pluginapi.Unhealthy {
+		device.Healthy = pluginapi.Unhealthy
+	} else if device.Healthy == pluginapi.Unhealthy &&
+		!device.shellMismatch && deviceReady(device) {
+		// the sensors recovered
+		device.Healthy = status
+	}
+	for _, node := range device.Nodes {
+		if node.DBDF != "" {
+			device.temp = GetTemperature(node.DBDF)
+			break
+		}
+	}
+	return device
+}
+
+// deviceReady re-reads the ready attribute of the device's PFs.
+// Boards without the attribute (AWS F1) count as ready.
+func deviceReady(device Device) bool {
+	for _, node := range device.Nodes {
+		if node.DBDF == "" {
+			continue
+		}
+		fname := path.Join(locator.DeviceDir(node.DBDF), ReadyFile)
+		if !FileExist(fname) {
+			continue
+		}
+		content, err := GetFileContent(fname)
+		if err != nil || strings.Compare(content, FPGAReady) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// GetDevicesCached is GetDevices behind a presence fingerprint: while
+// the set of PCI devices is unchanged it reuses the last scan's
+// metadata and only re-reads the health sensors. Any change to the ID
+// set triggers a full rescan.
+func GetDevicesCached() (map[string]Device, []DeviceError, error) {
+	ids, err := listPCIDevices()
+	if err != nil {
+		return nil, nil, err
+	}
+	fingerprint := strings.Join(ids, ",")
+
+	devCache.Lock()
+	defer devCache.Unlock()
+	if fingerprint == devCache.fingerprint && devCache.devices != nil {
+		defer beginScanCache()()
+		refreshed := make(map[string]Device, len(devCache.devices))
+		for sn, device := range devCache.devices {
+			refreshed[sn] = refreshHealth(device)
+		}
+		devCache.devices = refreshed
+		return refreshed, devCache.diags, nil
+	}
+
+	devices, diags, err := GetDevices()
+	if err != nil {
+		return nil, diags, err
+	}
+	devCache.fingerprint = fingerprint
+	devCache.devices = devices
+	devCache.diags = diags
+	return devices, diags, nil
+}
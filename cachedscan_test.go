@@ -0,0 +1,152 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+func TestGetDevicesCached(t *testing.T) {
+	defer func() {
+		locator = pciLocator{root: SysfsDevices}
+		devCache.Lock()
+		devCache.fingerprint = ""
+		devCache.devices = nil
+		devCache.diags = nil
+		devCache.Unlock()
+	}()
+
+	root := t.TempDir()
+	devDir := plantUserPF(t, root, "0000:65:00.1", "SN-A", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+	locator = pciLocator{root: root}
+
+	devices, _, err := GetDevicesCached()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if devices["SN-A"].Healthy != pluginapi.Healthy {
+		t.Fatalf("initial scan: %+v", devices["SN-A"])
+	}
+
+	// while the PCI ID set is unchanged the metadata is served from
+	// cache: a changed serial file is not re-read...
+	if err := ioutil.WriteFile(path.Join(devDir, "xmc.u129", SerialNumFile), []byte("SN-CHANGED\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// ...but health is re-graded every poll
+	if err := ioutil.WriteFile(path.Join(devDir, "xmc.u129", XMCTempFile), []byte("120\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	devices, _, err = GetDevicesCached()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, ok := devices["SN-A"]
+	if !ok {
+		t.Fatalf("cached scan lost the card: %v", devices)
+	}
+	if device.Healthy != pluginapi.Unhealthy {
+		t.Errorf("over-temperature not caught on cached poll: %+v", device)
+	}
+	if device.temp != 120 {
+		t.Errorf("temperature not refreshed: %d", device.temp)
+	}
+
+	// a new PCI ID invalidates the fingerprint and forces a full rescan
+	plantUserPF(t, root, "0000:d8:00.1", "SN-B", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+	devices, _, err = GetDevicesCached()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := devices["SN-B"]; !ok {
+		t.Errorf("hotplugged card not discovered: %v", devices)
+	}
+	if _, ok := devices["SN-CHANGED"]; !ok {
+		t.Errorf("full rescan should re-read metadata: %v", devices)
+	}
+}
+
+// A card marked Unhealthy for a non-sensor reason must not be flipped
+// back to Healthy by a cached poll: healthy sensors are not allowed to
+// clear an Unhealthy they didn't cause.
+func TestGetDevicesCachedKeepsNonSensorUnhealthy(t *testing.T) {
+	resetCache := func() {
+		devCache.Lock()
+		devCache.fingerprint = ""
+		devCache.devices = nil
+		devCache.diags = nil
+		devCache.Unlock()
+	}
+	defer func() {
+		locator = pciLocator{root: SysfsDevices}
+		expectedShells = make(map[string]string)
+		resetCache()
+	}()
+
+	// a still-initializing card stays withheld until ready reads 0x1
+	root := t.TempDir()
+	devDir := plantUserPF(t, root, "0000:65:00.1", "SN-A", "xilinx_u250_xdma_201830_2", "1561465320", "0x0")
+	locator = pciLocator{root: root}
+
+	devices, _, err := GetDevicesCached()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if devices["SN-A"].Healthy != pluginapi.Unhealthy {
+		t.Fatalf("unready card: %+v", devices["SN-A"])
+	}
+	devices, _, err = GetDevicesCached()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if devices["SN-A"].Healthy != pluginapi.Unhealthy {
+		t.Errorf("cached poll cleared the not-ready Unhealthy: %+v", devices["SN-A"])
+	}
+	// the shell finished initializing: the next cached poll recovers it
+	if err := ioutil.WriteFile(path.Join(devDir, ReadyFile), []byte(FPGAReady+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	devices, _, err = GetDevicesCached()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if devices["SN-A"].Healthy != pluginapi.Healthy {
+		t.Errorf("card not recovered after ready flipped: %+v", devices["SN-A"])
+	}
+
+	// an -expected-shell mismatch stays withheld on cached polls; the
+	// running shell can only change with a full rescan
+	resetCache()
+	expectedShells = map[string]string{"0x5001": "xilinx_u280_xdma_201920_1"}
+	devices, _, err = GetDevicesCached()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if devices["SN-A"].Healthy != pluginapi.Unhealthy || !devices["SN-A"].shellMismatch {
+		t.Fatalf("mismatched shell: %+v", devices["SN-A"])
+	}
+	devices, _, err = GetDevicesCached()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if devices["SN-A"].Healthy != pluginapi.Unhealthy {
+		t.Errorf("cached poll cleared the shell-mismatch Unhealthy: %+v", devices["SN-A"])
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// capabilityPools, when enabled, advertises every card both under a
+// generic pool ("any FPGA") and under one pool per capability derived
+// from discovery (e.g. has HBM, has QDMA). Since kubelet accounts each
+// resource independently, the plugin itself prevents double use: a card
+// allocated through one pool is reported Unhealthy in all others.
+var capabilityPools bool
+
+const (
+	genericPool   = "generic"
+	capPoolPrefix = "cap-"
+)
+
+// deviceCapabilities derives the capability tags of a card from its
+// discovery data.
+func deviceCapabilities(d Device) []string {
+	var caps []string
+	for _, node := range d.Nodes {
+		if node.Qdma != "" {
+			caps = append(caps, "qdma")
+			break
+		}
+	}
+	shell := strings.ToLower(d.shellVer)
+	if strings.Contains(shell, "u50") || strings.Contains(shell, "u55") ||
+		strings.Contains(shell, "u280") || strings.Contains(shell, "hbm") {
+		caps = append(caps, "hbm")
+	}
+	if strings.Contains(shell, "qep") || strings.Contains(shell, "qsfp") {
+		caps = append(caps, "qsfp")
+	}
+	return caps
+}
+
+// addCapabilityPools augments the per-DSA-type device map with the
+// generic pool and one pool per observed capability.
+func addCapabilityPools(devMap map[string]map[string]Device) {
+	if !capabilityPools {
+		return
+	}
+	generic := make(map[string]Device)
+	pools := make(map[string]map[string]Device)
+	for _, subMap := range devMap {
+		for sn, device := range subMap {
+			generic[sn] = device
+			for _, cap := range deviceCapabilities(device) {
+				if pools[cap] == nil {
+					pools[cap] = make(map[string]Device)
+				}
+				pools[cap][sn] = device
+			}
+		}
+	}
+	if len(generic) > 0 {
+		devMap[genericPool] = generic
+	}
+	for cap, subMap := range pools {
+		devMap[capPoolPrefix+cap] = subMap
+	}
+}
+
+// allocAccounting records which pool a card was allocated through, so
+// the same card is never handed out twice via different pools. Like
+// markAllocated, ownership is permanent because the v1beta1 API has no
+// deallocation callback.
+type allocAccounting struct {
+	sync.Mutex
+	owner map[string]string
+}
+
+var capAccounting = allocAccounting{owner: make(map[string]string)}
+
+// claim records pool as the owner of sn. It reports false when the card
+// is already owned by a different pool.
+func (a *allocAccounting) claim(sn, pool string) bool {
+	a.Lock()
+	defer a.Unlock()
+	if owner, ok := a.owner[sn]; ok && owner != pool {
+		return false
+	}
+	a.owner[sn] = pool
+	return true
+}
+
+// ownerOf returns the pool that owns sn, if any.
+func (a *allocAccounting) ownerOf(sn string) (string, bool) {
+	a.Lock()
+	defer a.Unlock()
+	owner, ok := a.owner[sn]
+	return owner, ok
+}
@@ -0,0 +1,114 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+func TestDeviceCapabilities(t *testing.T) {
+	hbmCard := Device{
+		shellVer: "xilinx_u50_gen3x16_xdma_201920_3",
+		Nodes:    []Node{{Qdma: "/dev/xfpga/dma.qdma.u256"}},
+	}
+	caps := deviceCapabilities(hbmCard)
+	if len(caps) != 2 || caps[0] != "qdma" || caps[1] != "hbm" {
+		t.Errorf("unexpected capabilities %v", caps)
+	}
+
+	plainCard := Device{shellVer: "xilinx_u250_xdma_201830_2"}
+	if caps := deviceCapabilities(plainCard); len(caps) != 0 {
+		t.Errorf("expected no capabilities, got %v", caps)
+	}
+}
+
+func TestAddCapabilityPools(t *testing.T) {
+	capabilityPools = true
+	defer func() { capabilityPools = false }()
+
+	devMap := map[string]map[string]Device{
+		"typeA": {
+			"serialA": {sn: "serialA", shellVer: "xilinx_u50_gen3x16_xdma_201920_3"},
+		},
+		"typeB": {
+			"serialB": {sn: "serialB", shellVer: "xilinx_u250_xdma_201830_2"},
+		},
+	}
+	addCapabilityPools(devMap)
+
+	generic, ok := devMap[genericPool]
+	if !ok || len(generic) != 2 {
+		t.Fatalf("generic pool should hold both cards, got %v", generic)
+	}
+	hbm, ok := devMap[capPoolPrefix+"hbm"]
+	if !ok || len(hbm) != 1 {
+		t.Fatalf("hbm pool should hold one card, got %v", hbm)
+	}
+	if _, ok := hbm["serialA"]; !ok {
+		t.Error("hbm pool missing serialA")
+	}
+}
+
+// TestCapabilityPoolAccounting proves a card allocated via a capability
+// pool is no longer schedulable through the generic pool.
+func TestCapabilityPoolAccounting(t *testing.T) {
+	capabilityPools = true
+	defer func() {
+		capabilityPools = false
+		capAccounting = allocAccounting{owner: make(map[string]string)}
+	}()
+
+	card := Device{
+		sn:       "serialA",
+		shellVer: "xilinx_u50_gen3x16_xdma_201920_3",
+		Healthy:  pluginapi.Healthy,
+		Nodes:    []Node{{User: "/dev/dri/renderD128", SubdevPath: "/dev/xfpga"}},
+	}
+	capServer := &FPGADevicePluginServer{
+		devType: capPoolPrefix + "hbm",
+		devices: map[string]Device{"serialA": card},
+	}
+	genericServer := &FPGADevicePluginServer{
+		devType: genericPool,
+		devices: map[string]Device{"serialA": card},
+	}
+
+	_, err := capServer.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"serialA"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dev := range genericServer.listDevices() {
+		if dev.ID == "serialA" && dev.Health != pluginapi.Unhealthy {
+			t.Error("serialA still healthy in generic pool after capability allocation")
+		}
+	}
+	// and allocating it again through the generic pool must fail
+	if _, err := genericServer.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"serialA"}},
+		},
+	}); err == nil {
+		t.Error("expected generic pool allocation of a claimed card to fail")
+	}
+}
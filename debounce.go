@@ -0,0 +1,97 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+// healthDebounceScans is how many consecutive scans a device must
+// report the same health state before the advertised health actually
+// changes. A transient bad reading (e.g. a temperature spike during a
+// burst workload) would otherwise flip a card to Unhealthy for one
+// scan, evict its pods, and flip right back. 1 disables the debounce.
+var healthDebounceScans = 3
+
+// debounceEntry is the per-serial debounce state.
+type debounceEntry struct {
+	advertised string // health currently advertised to kubelet
+	candidate  string // differing health observed on recent scans
+	streak     int    // consecutive scans candidate has been observed
+}
+
+// healthDebouncer suppresses health transitions until they have held
+// for healthDebounceScans consecutive scans. It remembers prior state
+// per serial number across scans; a card that disappears is forgotten,
+// so it starts fresh when it comes back.
+type healthDebouncer struct {
+	state map[string]*debounceEntry
+}
+
+func newHealthDebouncer() *healthDebouncer {
+	return &healthDebouncer{state: make(map[string]*debounceEntry)}
+}
+
+// apply rewrites the health of the devices in devMap to the debounced
+// value. The first sighting of a serial is advertised as observed; only
+// transitions after that are held back.
+func (d *healthDebouncer) apply(devMap map[string]map[string]Device) map[string]map[string]Device {
+	if healthDebounceScans <= 1 {
+		return devMap
+	}
+	seen := make(map[string]bool)
+	for _, subMap := range devMap {
+		for sn, device := range subMap {
+			seen[sn] = true
+			entry, ok := d.state[sn]
+			if !ok {
+				d.state[sn] = &debounceEntry{advertised: device.Healthy}
+				continue
+			}
+			if device.Healthy == entry.advertised {
+				// back in line with what is advertised; any pending
+				// transition was a blip
+				entry.candidate = ""
+				entry.streak = 0
+				continue
+			}
+			if device.Healthy == entry.candidate {
+				entry.streak++
+			} else {
+				entry.candidate = device.Healthy
+				entry.streak = 1
+			}
+			if entry.streak >= healthDebounceScans {
+				log.Infof("Card %s health settled at %s after %d scan(s), was %s",
+					sn, entry.candidate, entry.streak, entry.advertised)
+				entry.advertised = entry.candidate
+				entry.candidate = ""
+				entry.streak = 0
+				continue
+			}
+			log.Debugf("Card %s reports %s (%d/%d scans), still advertising %s",
+				sn, device.Healthy, entry.streak, healthDebounceScans, entry.advertised)
+			device.Healthy = entry.advertised
+			subMap[sn] = device
+		}
+	}
+	for sn := range d.state {
+		if !seen[sn] {
+			delete(d.state, sn)
+		}
+	}
+	return devMap
+}
@@ -0,0 +1,103 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+// debounceScan runs one debounced scan observing the given health for
+// serial "sn0" and returns the health that would be advertised.
+func debounceScan(d *healthDebouncer, observed string) string {
+	devMap := map[string]map[string]Device{
+		"res": {"sn0": Device{sn: "sn0", Healthy: observed}},
+	}
+	devMap = d.apply(devMap)
+	return devMap["res"]["sn0"].Healthy
+}
+
+func TestHealthDebounceHoldsTransition(t *testing.T) {
+	oldScans := healthDebounceScans
+	healthDebounceScans = 3
+	defer func() { healthDebounceScans = oldScans }()
+	d := newHealthDebouncer()
+
+	// first sighting is advertised as observed
+	if got := debounceScan(d, pluginapi.Healthy); got != pluginapi.Healthy {
+		t.Fatalf("first scan advertised %s, expected Healthy", got)
+	}
+	// two bad scans are not enough to flip
+	for i := 0; i < 2; i++ {
+		if got := debounceScan(d, pluginapi.Unhealthy); got != pluginapi.Healthy {
+			t.Fatalf("scan %d advertised %s, expected the debounce to hold Healthy", i+2, got)
+		}
+	}
+	// the third consecutive bad scan flips the advertised health
+	if got := debounceScan(d, pluginapi.Unhealthy); got != pluginapi.Unhealthy {
+		t.Fatalf("third bad scan advertised %s, expected Unhealthy", got)
+	}
+	// and the way back is debounced too
+	if got := debounceScan(d, pluginapi.Healthy); got != pluginapi.Unhealthy {
+		t.Fatalf("first recovered scan advertised %s, expected Unhealthy", got)
+	}
+}
+
+func TestHealthDebounceResetOnFlap(t *testing.T) {
+	oldScans := healthDebounceScans
+	healthDebounceScans = 3
+	defer func() { healthDebounceScans = oldScans }()
+	d := newHealthDebouncer()
+
+	debounceScan(d, pluginapi.Healthy)
+	// a single-scan spike past threshold never reaches kubelet
+	debounceScan(d, pluginapi.Unhealthy)
+	debounceScan(d, pluginapi.Healthy)
+	for i := 0; i < 2; i++ {
+		if got := debounceScan(d, pluginapi.Unhealthy); got != pluginapi.Healthy {
+			t.Fatalf("streak should have restarted after the flap, got %s", got)
+		}
+	}
+}
+
+func TestHealthDebounceForgetsDepartedCards(t *testing.T) {
+	oldScans := healthDebounceScans
+	healthDebounceScans = 3
+	defer func() { healthDebounceScans = oldScans }()
+	d := newHealthDebouncer()
+
+	debounceScan(d, pluginapi.Healthy)
+	// the card disappears for a scan, e.g. over a reflash
+	d.apply(map[string]map[string]Device{})
+	// on return it starts fresh: the observed health is advertised
+	// immediately, even though it differs from before
+	if got := debounceScan(d, pluginapi.Unhealthy); got != pluginapi.Unhealthy {
+		t.Fatalf("re-appearing card advertised %s, expected Unhealthy", got)
+	}
+}
+
+func TestHealthDebounceDisabled(t *testing.T) {
+	oldScans := healthDebounceScans
+	healthDebounceScans = 1
+	defer func() { healthDebounceScans = oldScans }()
+	d := newHealthDebouncer()
+
+	debounceScan(d, pluginapi.Healthy)
+	if got := debounceScan(d, pluginapi.Unhealthy); got != pluginapi.Unhealthy {
+		t.Fatalf("debounce of 1 advertised %s, expected the change to pass through", got)
+	}
+}
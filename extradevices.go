@@ -0,0 +1,107 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+)
+
+// extraDeviceRules maps a shell version to glob patterns for additional
+// device nodes to mount during Allocate. Custom shells can expose nodes
+// (e.g. an interrupt node under /dev/xfpga) that don't follow the
+// .u<instance> naming discovery groups by, so they would otherwise never
+// reach the pod. Empty when no rules file is configured.
+var extraDeviceRules = make(map[string][]string)
+
+// loadExtraDeviceRules reads and validates the shell version to device
+// node pattern mapping file. Invalid entries fail the load as a whole so
+// a typo does not silently drop nodes.
+func loadExtraDeviceRules(fname string) error {
+	buf, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return fmt.Errorf("Can't read extra devices config %s: %v", fname, err)
+	}
+	rules := make(map[string][]string)
+	if err := json.Unmarshal(buf, &rules); err != nil {
+		return fmt.Errorf("Can't parse extra devices config %s: %v", fname, err)
+	}
+	for shell, patterns := range rules {
+		if shell == "" {
+			return fmt.Errorf("extra devices config %s: empty shell version key", fname)
+		}
+		for _, pattern := range patterns {
+			if pattern == "" {
+				return fmt.Errorf("extra devices config %s: empty pattern for shell %s",
+					fname, shell)
+			}
+			// only nodes under /dev make sense as device mounts;
+			// relative patterns expand under the subdev prefix
+			if strings.HasPrefix(pattern, "/") && !strings.HasPrefix(pattern, "/dev/") {
+				return fmt.Errorf("extra devices config %s: pattern %s for shell %s is outside /dev",
+					fname, pattern, shell)
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("extra devices config %s: bad pattern %s for shell %s: %v",
+					fname, pattern, shell, err)
+			}
+		}
+	}
+	extraDeviceRules = rules
+	return nil
+}
+
+// expandExtraDevices expands the patterns configured for shell against
+// the nodes present on the host. Relative patterns match names under the
+// subdev prefix, absolute ones match under their own directory. Shells
+// without a rule get nil, leaving allocation exactly as before.
+func expandExtraDevices(shell string) []string {
+	patterns, ok := extraDeviceRules[shell]
+	if !ok {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var nodes []string
+	for _, pattern := range patterns {
+		dir := SubdevPrefix
+		base := pattern
+		if strings.HasPrefix(pattern, "/") {
+			dir, base = path.Split(pattern)
+			dir = strings.TrimSuffix(dir, "/")
+		}
+		files, err := fsys.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if matched, _ := path.Match(base, file.Name()); !matched {
+				continue
+			}
+			node := path.Join(dir, file.Name())
+			if seen[node] {
+				continue
+			}
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
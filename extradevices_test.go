@@ -0,0 +1,103 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeRules(t *testing.T, content string) string {
+	t.Helper()
+	fname := path.Join(t.TempDir(), "extra.json")
+	if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func TestLoadExtraDeviceRules(t *testing.T) {
+	defer func() { extraDeviceRules = make(map[string][]string) }()
+
+	cases := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"valid rules load", `{"xilinx_u250_xdma_201830_2": ["irq.*", "/dev/custom0"]}`, ""},
+		{"absolute path outside /dev", `{"shell": ["/sys/kernel/foo"]}`, "outside /dev"},
+		{"malformed glob", `{"shell": ["irq.[*"]}`, "bad pattern"},
+		{"empty shell key", `{"": ["irq.*"]}`, "empty shell version key"},
+		{"empty pattern", `{"shell": [""]}`, "empty pattern"},
+		{"not json", `patterns: [irq]`, "Can't parse"},
+	}
+	for _, c := range cases {
+		err := loadExtraDeviceRules(writeRules(t, c.content))
+		if c.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", c.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+			t.Errorf("%s: error = %v, want %q", c.name, err, c.wantErr)
+		}
+	}
+
+	// a failed load keeps the previous rules
+	if err := loadExtraDeviceRules(writeRules(t, `{"shell": ["irq.*"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadExtraDeviceRules(writeRules(t, `{"": ["x"]}`)); err == nil {
+		t.Fatal("invalid rules loaded without error")
+	}
+	if _, ok := extraDeviceRules["shell"]; !ok {
+		t.Error("valid rules dropped by a failed reload")
+	}
+}
+
+func TestExpandExtraDevices(t *testing.T) {
+	defer func() {
+		extraDeviceRules = make(map[string][]string)
+		fsys = osFS{}
+	}()
+	fsys = memFS{files: map[string]string{
+		"/dev/xfpga/irq.custom0":     "",
+		"/dev/xfpga/irq.custom1":     "",
+		"/dev/xfpga/dma.qdma.u25857": "",
+		"/dev/fpga-sideband0":        "",
+	}}
+	extraDeviceRules = map[string][]string{
+		"xilinx_u250_xdma_201830_2": {"irq.custom*", "/dev/fpga-sideband*"},
+	}
+
+	got := expandExtraDevices("xilinx_u250_xdma_201830_2")
+	want := []string{
+		"/dev/fpga-sideband0",
+		"/dev/xfpga/irq.custom0",
+		"/dev/xfpga/irq.custom1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expandExtraDevices = %v, want %v", got, want)
+	}
+
+	if nodes := expandExtraDevices("some_other_shell"); nodes != nil {
+		t.Errorf("unmatched shell expanded to %v, want nil", nodes)
+	}
+}
@@ -16,111 +16,636 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+	"io"
 	"io/ioutil"
 	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
 	"os"
 	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The sysfs and /dev roots are variables so a containerized plugin can
+// point them at the host mounts (e.g. /host-sys) via -sysfs-root and
+// -dev-root; they default to running directly on the host namespaces.
+var (
+	SysfsDevices = "/sys/bus/pci/devices"
+	UserPrefix   = "/dev/dri"
+	SubdevPrefix = "/dev/xfpga"
 )
 
 const (
-	SysfsDevices   = "/sys/bus/pci/devices"
-	UserPrefix     = "/dev/dri"
-	SubdevPrefix   = "/dev/xfpga"
-	QDMASTR        = "dma.qdma.u"
-	UserPFKeyword  = "drm"
-	DRMSTR         = "renderD"
-	ROMSTR         = "rom.u"
-	DSAverFile     = "VBNV"
-	DSAtsFile      = "timestamp"
-	XMCSTR         = "xmc.u"
-	SerialNumFile  = "serial_num"
+	QDMASTR       = "dma.qdma.u"
+	UserPFKeyword = "drm"
+	DRMSTR        = "renderD"
+	ROMSTR        = "rom.u"
+	DSAverFile    = "VBNV"
+	DSAtsFile     = "timestamp"
+	XMCSTR        = "xmc.u"
+	XMGMTSTR      = "xmgmt_main.u"
+	SerialNumFile = "serial_num"
+	// Advantech boards expose the board metadata as flat attributes
+	// under their own names instead of the Xilinx subdevice folders
+	AdvantechSerialFile = "board_serial"
+	AdvantechShellFile  = "board_name"
+	AdvantechTsFile     = "build_date"
+	// BoardInfoFile is the combined key/value attribute newer shells
+	// expose instead of the standalone serial_num file
+	BoardInfoFile  = "board_info"
+	XclbinUUIDFile = "xclbinuuid"
 	MgmtFile       = "mgmt_pf"
 	UserFile       = "user_pf"
 	VendorFile     = "vendor"
 	DeviceFile     = "device"
+	ClassFile      = "class"
 	ReadyFile      = "ready"
+	NumCUsFile     = "kds_numcus"
+	ICAPSTR        = "icap.u"
+	ClockFreqsFile = "clock_freqs"
+	ResetTypeFile  = "reset_type"
+	PowerModeFile  = "power_mode"
+	NumaNodeFile   = "numa_node"
+	// XMC sensor attributes used for health grading
+	XMCTempFile     = "xmc_temp"
+	XMCPowerFile    = "xmc_power"
+	XMCFanSpeedFile = "xmc_fan_speed"
+	// newer XMC firmware renamed the fan attribute
+	XMCFanRPMFile  = "xmc_fan_rpm"
 	FPGAReady      = "0x1"
 	XilinxVendorID = "0x10ee"
 	ADVANTECH_ID   = "0x13fe"
 	AWS_ID         = "0x1d0f"
+	// HealthDegraded is an internal health level for cards that are
+	// usable but known to be in a bad configuration (e.g. user/golden
+	// VBNV mismatch). It is mapped onto the two kubelet health values
+	// when the device list is sent.
+	HealthDegraded = "Degraded"
+	// Recovery actions for hung or degraded cards. Hot reset means the
+	// sysfs-triggered reset is expected to help; cold reboot means a
+	// full host reboot is needed.
+	RecoveryHotReset   = "hot-reset"
+	RecoveryColdReboot = "cold-reboot"
 )
 
 type Node struct {
 	User       string
 	SubdevPath string
-	Qdma       string
-	DBDF       string // this is for user pf
-	deviceID   string //devid of the user pf
+	// SubdevNodes are the individual /dev/xfpga nodes belonging to this
+	// card's instance. When populated, Allocate passes exactly these
+	// instead of the whole SubdevPath directory, so a pod never sees
+	// nodes of other cards.
+	SubdevNodes []string
+	// ExtraDevices are additional nodes mounted for this card because an
+	// operator rule matched its shell version, see extraDeviceRules
+	ExtraDevices []string
+	// Qdma is the first QDMA node for this card, kept for callers that
+	// predate multi-queue support; Qdmas has every instance
+	Qdma  string
+	Qdmas []string
+	DBDF  string // this is for user pf
+	// AWSSlot is the F1 slot number this node belongs to, empty for
+	// non-AWS cards
+	AWSSlot string
+	// NUMA is the NUMA node this card is attached to, -1 when unknown
+	NUMA int
+	// ParentSwitch is the BDF of the upstream PCI bridge, empty when
+	// the card hangs directly off the root complex
+	ParentSwitch string
+	deviceID     string //devid of the user pf
 }
 
 type Device struct {
-	sn        string
-	shellVer  string
+	sn       string
+	shellVer string
+	// vbnv is shellVer parsed into its components, zero when shellVer
+	// doesn't follow the vendor_board_name_version convention
+	vbnv      VBNV
 	timestamp string
-	Healthy   string
-	Nodes     []Node
+	// tsValue is timestamp parsed to a number for comparisons. Zero when
+	// the raw string could not be parsed.
+	tsValue    uint64
+	xclbinUUID string // UUID of the loaded user bitstream, empty if none
+	// cuCount is the number of compute units exposed by the loaded
+	// xclbin, 0 when unknown
+	cuCount int
+	Healthy string
+	// degradedReason says why Healthy is HealthDegraded, empty otherwise
+	degradedReason string
+	// recoveryAction says what would clear a hang on this card; defaults
+	// to RecoveryHotReset when the driver can't distinguish
+	recoveryAction string
+	// powerProfile is the active power/performance profile, empty when
+	// the shell doesn't report one
+	powerProfile string
+	// clockFreqs are the kernel clock frequencies of the loaded shell,
+	// comma separated, empty when the icap attribute is absent
+	clockFreqs string
+	// shellMismatch is set when the running shell differs from the
+	// golden VBNV configured for this device id via -expected-shell
+	shellMismatch bool
+	// temp is the FPGA die temperature in Celsius at scan time, 0 when
+	// the board doesn't report one
+	temp  uint64
+	Nodes []Node
+}
+
+// DeviceSpecs emits the device node host/container path pairs for
+// every node of this card, so Allocate hands the whole physical FPGA
+// (user PF, per-instance subdev nodes and the QDMA node when present)
+// to the container together. Nodes with an empty path are omitted.
+func (d Device) DeviceSpecs() []*pluginapi.DeviceSpec {
+	var specs []*pluginapi.DeviceSpec
+	add := func(path string) {
+		specs = append(specs, &pluginapi.DeviceSpec{
+			HostPath:      path,
+			ContainerPath: path,
+			Permissions:   "rwm",
+		})
+	}
+	for _, node := range d.Nodes {
+		// AWS F1 nodes have no render node; everything they need is
+		// in SubdevNodes
+		if node.User != "" {
+			add(node.User)
+		}
+		for _, subdev := range node.SubdevNodes {
+			add(subdev)
+		}
+		for _, extra := range node.ExtraDevices {
+			add(extra)
+		}
+		if len(node.Qdmas) > 0 {
+			for _, qdma := range node.Qdmas {
+				add(qdma)
+			}
+		} else if node.Qdma != "" {
+			// nodes built before multi-queue support only carry the
+			// single path
+			add(node.Qdma)
+		}
+	}
+	return specs
+}
+
+// expectedXclbins maps a shell version to the xclbin UUID expected to be
+// loaded on cards running that shell. Populated from the command line.
+var expectedXclbins = make(map[string]string)
+
+// expectedShells maps a PCI device id to the shell VBNV every board of
+// that model is expected to run. Boards flashed with anything else are
+// reported unhealthy until reflashed. Populated from the command line;
+// empty leaves behavior unchanged.
+var expectedShells = make(map[string]string)
+
+// minTimestamps maps a shell version to the minimum DSA build timestamp
+// a card must have to be advertised. Populated from the command line.
+var minTimestamps = make(map[string]uint64)
+
+// ParseTimestamp parses the DSA build timestamp sysfs value, which the
+// Xilinx tools emit either as hex (with or without 0x prefix) or as
+// decimal depending on release.
+func ParseTimestamp(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("empty timestamp")
+	}
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		return strconv.ParseUint(s[2:], 16, 64)
+	}
+	if v, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return v, nil
+	}
+	return strconv.ParseUint(s, 16, 64)
+}
+
+// TimestampNewerThan reports whether the device's DSA build timestamp
+// is strictly newer than other. A device whose timestamp didn't parse
+// carries tsValue 0 and is never newer than anything, so "shell newer
+// than X" policies skip it instead of matching it by accident.
+func (d Device) TimestampNewerThan(other uint64) bool {
+	return d.tsValue != 0 && d.tsValue > other
+}
+
+// VBNV is the parsed form of a shell version string such as
+// xilinx_u250_gen3x16_xdma_3_1_202020_1: the vendor, the board, the
+// shell (interface) name, and the trailing version components. Callers
+// use it to schedule on board family regardless of exact revision.
+type VBNV struct {
+	Vendor  string `json:"vendor"`
+	Board   string `json:"board"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// ParseVBNV splits a VBNV string into its components. The version is
+// the trailing run of numeric fields; everything between the board and
+// the version is the shell name. Truncated or malformed strings error
+// rather than yielding a half-filled struct.
+func ParseVBNV(s string) (VBNV, error) {
+	parts := strings.Split(s, "_")
+	if len(parts) < 4 {
+		return VBNV{}, fmt.Errorf("invalid VBNV %q: expect vendor_board_name_version", s)
+	}
+	isNumeric := func(s string) bool {
+		_, err := strconv.ParseUint(s, 10, 64)
+		return err == nil
+	}
+	i := len(parts)
+	for i > 3 && isNumeric(parts[i-1]) {
+		i--
+	}
+	if i == len(parts) {
+		return VBNV{}, fmt.Errorf("invalid VBNV %q: no version suffix", s)
+	}
+	if parts[0] == "" || parts[1] == "" {
+		return VBNV{}, fmt.Errorf("invalid VBNV %q: empty vendor or board", s)
+	}
+	name := strings.Join(parts[2:i], "_")
+	if name == "" {
+		return VBNV{}, fmt.Errorf("invalid VBNV %q: empty shell name", s)
+	}
+	return VBNV{
+		Vendor:  parts[0],
+		Board:   parts[1],
+		Name:    name,
+		Version: strings.Join(parts[i:], "_"),
+	}, nil
+}
+
+// GetRecoveryAction reports whether a hang on the card would be cleared
+// by a hot reset or needs a full host reboot, where the driver exposes
+// the distinction. Drivers that don't are assumed hot-resettable.
+func GetRecoveryAction(pciID string) string {
+	fname := path.Join(locator.DeviceDir(pciID), ResetTypeFile)
+	if !FileExist(fname) {
+		return RecoveryHotReset
+	}
+	content, err := GetFileContent(fname)
+	if err != nil {
+		return RecoveryHotReset
+	}
+	if strings.Contains(strings.ToLower(content), "cold") {
+		return RecoveryColdReboot
+	}
+	return RecoveryHotReset
+}
+
+// GetPowerProfile returns the card's active power/performance profile,
+// or empty for shells without the feature. A card silently dropping
+// into a throttled profile is a common cause of "my FPGA is slow"
+// tickets, so power-save profiles are logged.
+func GetPowerProfile(pciID string) string {
+	fname := path.Join(locator.DeviceDir(pciID), PowerModeFile)
+	if !FileExist(fname) {
+		return ""
+	}
+	content, err := GetFileContent(fname)
+	if err != nil {
+		return ""
+	}
+	profile := strings.ToLower(content)
+	if strings.Contains(profile, "save") || strings.Contains(profile, "low") {
+		log.WithFields(log.Fields{
+			"bdf":     pciID,
+			"profile": profile,
+		}).Warn("Card is in a power-save profile; performance will be reduced")
+	}
+	return profile
 }
 
+// GetCUCount returns the number of compute units of the xclbin loaded
+// on the card, or 0 when the shell doesn't expose it or none is loaded.
+func GetCUCount(pciID string) int {
+	fname := path.Join(locator.DeviceDir(pciID), NumCUsFile)
+	if !FileExist(fname) {
+		return 0
+	}
+	content, err := GetFileContent(fname)
+	if err != nil {
+		return 0
+	}
+	count, err := strconv.Atoi(content)
+	if err != nil || count < 0 {
+		return 0
+	}
+	return count
+}
+
+// GetXclbinUUID returns the UUID of the xclbin currently loaded on the
+// card, read from the user PF sysfs entry. Cards with no xclbin loaded
+// (or shells predating the sysfs node) yield an empty string.
+func GetXclbinUUID(pciID string) string {
+	fname := path.Join(locator.DeviceDir(pciID), XclbinUUIDFile)
+	if !FileExist(fname) {
+		return ""
+	}
+	content, err := GetFileContent(fname)
+	if err != nil {
+		return ""
+	}
+	// an all-zero UUID means nothing is programmed
+	if strings.Trim(strings.Replace(content, "-", "", -1), "0") == "" {
+		return ""
+	}
+	return content
+}
+
+// extraVendorIDs augments the built-in vendor allowlist (Xilinx, AWS,
+// Advantech) with operator supplied IDs, for OEM-rebranded cards that
+// report their own vendor. Normalized to 0x-prefixed lower case.
+var extraVendorIDs []string
+
+// parseVendorIDs validates a comma separated hex vendor ID list from
+// the command line and normalizes each entry to the 0x%04x form sysfs
+// reports, so comparisons stay simple string equality.
+func parseVendorIDs(list string) ([]string, error) {
+	var ids []string
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(entry), "0x"), 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vendor ID %q: expect a 16 bit hex value", entry)
+		}
+		ids = append(ids, fmt.Sprintf("0x%04x", id))
+	}
+	return ids, nil
+}
+
+// isKnownVendor reports whether vendorID belongs to a recognized FPGA
+// vendor: the built-in three or an ID added via -vendor-ids.
+func isKnownVendor(vendorID string) bool {
+	if strings.EqualFold(vendorID, XilinxVendorID) ||
+		strings.EqualFold(vendorID, AWS_ID) ||
+		strings.EqualFold(vendorID, ADVANTECH_ID) {
+		return true
+	}
+	for _, id := range extraVendorIDs {
+		if strings.EqualFold(vendorID, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPCIBridge reports whether the device directory belongs to a PCI
+// bridge rather than an endpoint function. The sysfs class attribute is
+// 0xCCSSPP (class, subclass, prog-if); class 0x06 covers host and
+// PCI-to-PCI bridges. A missing or unreadable class file counts as not
+// a bridge, keeping discovery working on sysfs layouts that omit it.
+func isPCIBridge(devDir string) bool {
+	content, err := GetFileContent(path.Join(devDir, ClassFile))
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(strings.ToLower(content), "0x06")
+}
+
+// GetClockFreqs returns the kernel clock frequencies of the loaded
+// shell, comma separated, read from the icap subdevice. Shells without
+// the attribute yield an empty string.
+func GetClockFreqs(pciID string) string {
+	devDir := locator.DeviceDir(pciID)
+	icapFolder, err := GetFileNameFromPrefix(devDir, ICAPSTR)
+	if err != nil || icapFolder == "" {
+		return ""
+	}
+	content, err := GetFileContent(path.Join(devDir, icapFolder, ClockFreqsFile))
+	if err != nil {
+		return ""
+	}
+	return strings.Join(strings.Fields(content), ",")
+}
+
+// includeBDFs, when non-empty, restricts discovery to the listed BDFs.
+// Cards outside the list are ignored entirely, for nodes where only
+// some FPGAs should be managed by this plugin.
+var includeBDFs map[string]bool
+
+var bdfPattern = regexp.MustCompile(`^[0-9a-fA-F]{4,}:[0-9a-fA-F]{2}:[0-9a-fA-F]{2}\.[0-7]$`)
+
+// parseBDFList validates a comma separated BDF allowlist of the form
+// dddd:bb:dd.f.
+func parseBDFList(list string) (map[string]bool, error) {
+	set := make(map[string]bool)
+	for _, bdf := range strings.Split(list, ",") {
+		bdf = strings.TrimSpace(bdf)
+		if bdf == "" {
+			continue
+		}
+		if !bdfPattern.MatchString(bdf) {
+			return nil, fmt.Errorf("invalid BDF %q, expect dddd:bb:dd.f", bdf)
+		}
+		set[strings.ToLower(bdf)] = true
+	}
+	return set, nil
+}
+
+// DeviceError records why one PCI device was skipped during discovery,
+// so a misconfigured or half-initialized card shows up in logs instead
+// of silently vanishing from the results.
+type DeviceError struct {
+	PciID string
+	Step  string // which discovery step failed, e.g. "serial_num unreadable"
+	Err   error
+}
+
+func (e DeviceError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("device %s skipped: %s: %v", e.PciID, e.Step, e.Err)
+	}
+	return fmt.Sprintf("device %s skipped: %s", e.PciID, e.Step)
+}
+
+// BDFParseError reports which component of a BDF string failed to
+// parse, so callers can distinguish e.g. a malformed domain from a
+// malformed function via errors.As.
+type BDFParseError struct {
+	Field string // "format", "domain", "bus", "device" or "function"
+	Value string
+	Err   error
+}
+
+func (e *BDFParseError) Error() string {
+	return fmt.Sprintf("Can't parse BDF %s %q: %v", e.Field, e.Value, e.Err)
+}
+
+func (e *BDFParseError) Unwrap() error { return e.Err }
+
 func GetInstance(DBDF string) (string, error) {
 	strArray := strings.Split(DBDF, ":")
-	domain, err := strconv.ParseUint(strArray[0], 16, 16)
-	if err != nil {
-		return "", fmt.Errorf("strconv failed: %s", strArray[0])
+	// domains can exceed 16 bits in virtualized and large-server
+	// environments (e.g. 10000:03:00.0); the instance formula below
+	// keeps the xocl driver's dom<<16|bus<<8|dev<<3|fn numbering,
+	// which is identical to the old multiply for narrow domains.
+	// Some tools hand back bb:dd.f with no domain at all; that is
+	// treated as domain 0.
+	var domain uint64
+	var err error
+	switch len(strArray) {
+	case 3:
+		domain, err = strconv.ParseUint(strArray[0], 16, 32)
+		if err != nil {
+			return "", &BDFParseError{Field: "domain", Value: strArray[0], Err: err}
+		}
+		strArray = strArray[1:]
+	case 2:
+	default:
+		return "", &BDFParseError{Field: "format", Value: DBDF,
+			Err: fmt.Errorf("expect [dddd:]bb:dd.f")}
 	}
-	bus, err := strconv.ParseUint(strArray[1], 16, 8)
+	bus, err := strconv.ParseUint(strArray[0], 16, 8)
 	if err != nil {
-		return "", fmt.Errorf("strconv failed: %s", strArray[1])
+		return "", &BDFParseError{Field: "bus", Value: strArray[0], Err: err}
+	}
+	strArray = strings.Split(strArray[1], ".")
+	if len(strArray) != 2 {
+		return "", &BDFParseError{Field: "format", Value: DBDF,
+			Err: fmt.Errorf("expect [dddd:]bb:dd.f")}
 	}
-	strArray = strings.Split(strArray[2], ".")
 	dev, err := strconv.ParseUint(strArray[0], 16, 8)
 	if err != nil {
-		return "", fmt.Errorf("strconv failed: %s", strArray[0])
+		return "", &BDFParseError{Field: "device", Value: strArray[0], Err: err}
 	}
 	fc, err := strconv.ParseUint(strArray[1], 16, 8)
 	if err != nil {
-		return "", fmt.Errorf("strconv failed: %s", strArray[1])
+		return "", &BDFParseError{Field: "function", Value: strArray[1], Err: err}
 	}
-	ret := domain*65536 + bus*256 + dev*8 + fc
+	ret := domain<<16 | bus<<8 | dev<<3 | fc
 	return strconv.FormatUint(ret, 10), nil
 }
 
+// GetFileNameFromPrefix returns the first entry of dir (in sorted
+// order) whose name starts with prefix, "" when none matches. Kept for
+// callers whose prefixes are unique per device, like rom.u.
 func GetFileNameFromPrefix(dir string, prefix string) (string, error) {
-	userFiles, err := ioutil.ReadDir(dir)
+	fnames, err := GetFileNamesFromPrefix(dir, prefix)
+	if err != nil {
+		return "", err
+	}
+	if len(fnames) == 0 {
+		return "", nil
+	}
+	return fnames[0], nil
+}
+
+// GetFileNamesFromPrefix returns every entry of dir whose name starts
+// with prefix, sorted so callers see the same order on every scan.
+// Cards configured with several QDMA instances expose one dma.qdma.u*
+// folder per queue, and drm can hold more than one render node, so
+// callers can't always stop at the first match.
+func GetFileNamesFromPrefix(dir string, prefix string) ([]string, error) {
+	userFiles, err := cachedReadDir(dir)
 	if err != nil {
-		return "", fmt.Errorf("Can't read folder %s", dir)
+		return nil, fmt.Errorf("Can't read folder %s", dir)
 	}
+	var fnames []string
 	for _, userFile := range userFiles {
 		fname := userFile.Name()
-
-		if !strings.HasPrefix(fname, prefix) {
-			continue
+		if strings.HasPrefix(fname, prefix) {
+			fnames = append(fnames, fname)
 		}
-		return fname, nil
 	}
-	return "", nil
+	sort.Strings(fnames)
+	return fnames, nil
+}
+
+// maxAttrSize bounds reads of large sysfs attributes (mem_topology and
+// friends) so a single malformed attribute can't consume unbounded
+// memory. Overridable from the command line.
+var maxAttrSize int64 = 1 << 20
+
+// GetFileContentBounded reads file fully, tolerating short reads, but
+// refuses attributes larger than max bytes with a clear error.
+func GetFileContentBounded(file string, max int64) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", fmt.Errorf("Can't read file %s: %v", file, err)
+	}
+	defer f.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(f, max+1))
+	if err != nil {
+		return "", fmt.Errorf("Can't read file %s: %v", file, err)
+	}
+	if int64(len(buf)) > max {
+		return "", fmt.Errorf("attribute %s exceeds the %d byte limit", file, max)
+	}
+	return strings.Trim(string(buf), "\n"), nil
+}
+
+// readRetries and readRetryDelay control the retry with backoff around
+// sysfs reads. A card going through FLR or a driver reload briefly
+// returns EIO on attributes that normally read fine, and a single
+// failed read would flap it out of the advertised list for a scan.
+// Genuinely missing files are never retried.
+var (
+	readRetries    = 2
+	readRetryDelay = 10 * time.Millisecond
+)
+
+// bootRetries and bootRetryDelay give a board that is still coming up a
+// few extra chances before the first scan writes it off. Right after
+// node boot or a driver reload the ready attribute may not exist yet,
+// or still read 0x0 while the shell initializes, and without patience
+// the plugin advertises zero devices until the next poll. The window
+// covers discovery only until its first scan completes; steady-state
+// rescans keep the fast single-read path so a healthy poll stays cheap.
+// main arms the window at startup; library callers and tests get the
+// plain path unless they arm it themselves.
+var (
+	bootRetries           = 3
+	bootRetryDelay        = 2 * time.Second
+	firstScanDone  uint32 = 1
+)
+
+func armBootWindow() {
+	atomic.StoreUint32(&firstScanDone, 0)
+}
+
+func inBootWindow() bool {
+	return atomic.LoadUint32(&firstScanDone) == 0
 }
 
 func GetFileContent(file string) (string, error) {
-	if buf, err := ioutil.ReadFile(file); err != nil {
-		return "", fmt.Errorf("Can't read file %s", file)
-	} else {
-		ret := strings.Trim(string(buf), "\n")
-		return ret, nil
+	delay := readRetryDelay
+	for attempt := 0; ; attempt++ {
+		buf, err := cachedReadFile(file)
+		if err == nil {
+			ret := strings.Trim(buf, "\n")
+			return ret, nil
+		}
+		if os.IsNotExist(err) || attempt >= readRetries {
+			// the cause is wrapped so callers can tell a missing
+			// optional attribute (errors.Is os.ErrNotExist) from a
+			// real I/O or permission problem
+			return "", fmt.Errorf("Can't read file %s: %w", file, err)
+		}
+		logger.Debugf("Transient error reading %s, retrying: %v", file, err)
+		time.Sleep(delay)
+		delay *= 2
 	}
 }
 
-//Prior to 2018.3 release, Xilinx FPGA has mgmt PF as func 1 and user PF
-//as func 0. The func numbers of the 2 PFs are swapped after 2018.3 release.
-//The FPGA device driver in (and after) 2018.3 release creates sysfs file --
-//mgmt_pf and user_pf accordingly to reflect what a PF really is.
+// Prior to 2018.3 release, Xilinx FPGA has mgmt PF as func 1 and user PF
+// as func 0. The func numbers of the 2 PFs are swapped after 2018.3 release.
+// The FPGA device driver in (and after) 2018.3 release creates sysfs file --
+// mgmt_pf and user_pf accordingly to reflect what a PF really is.
 //
-//The plugin will rely on this info to determine whether the a entry is mgmtPF,
-//userPF, or none. This also means, it will not support 2018.2 any more.
+// The plugin will rely on this info to determine whether the a entry is mgmtPF,
+// userPF, or none. This also means, it will not support 2018.2 any more.
 func FileExist(fname string) bool {
-	if _, err := os.Stat(fname); err != nil {
+	if _, err := fsys.Stat(fname); err != nil {
 		if os.IsNotExist(err) {
 			return false
 		}
@@ -129,138 +654,933 @@ func FileExist(fname string) bool {
 }
 
 func IsMgmtPf(pciID string) bool {
-	fname := path.Join(SysfsDevices, pciID, MgmtFile)
+	fname := path.Join(locator.DeviceDir(pciID), MgmtFile)
 	return FileExist(fname)
 }
 
-func IsUserPf(pciID string) bool {
-	fname := path.Join(SysfsDevices, pciID, UserFile)
-	return FileExist(fname)
-}
+// requireMgmtPF, when set, restricts discovery to cards whose mgmt PF is
+// also visible on the host. Clusters that want full control of the card
+// (including programming) use this to reject user-only passthrough.
+var requireMgmtPF bool
 
-func GetDevices() (map[string]Device, error) {
-	devices := make(map[string]Device)
-	pciFiles, err := ioutil.ReadDir(SysfsDevices)
+// getMgmtSerials walks root and returns the serial numbers of all mgmt
+// PFs found there, for correlating user PFs with their mgmt sibling.
+func getMgmtSerials(root string) map[string]bool {
+	serials := make(map[string]bool)
+	pciFiles, err := fsys.ReadDir(root)
 	if err != nil {
-		return nil, fmt.Errorf("Can't read folder %s", SysfsDevices)
+		return serials
 	}
+	for _, pciFile := range pciFiles {
+		pciID := pciFile.Name()
+		if !FileExist(path.Join(root, pciID, MgmtFile)) {
+			continue
+		}
+		xmcFolder, err := GetFileNameFromPrefix(path.Join(root, pciID), XMCSTR)
+		if err != nil || xmcFolder == "" {
+			continue
+		}
+		sn, err := GetFileContent(path.Join(root, pciID, xmcFolder, SerialNumFile))
+		if err != nil || sn == "" {
+			continue
+		}
+		serials[sn] = true
+	}
+	return serials
+}
 
+// getMgmtVBNVs walks root and returns the golden side VBNV of every
+// mgmt PF found there, keyed by serial number.
+func getMgmtVBNVs(root string) map[string]string {
+	vbnvs := make(map[string]string)
+	pciFiles, err := fsys.ReadDir(root)
+	if err != nil {
+		return vbnvs
+	}
 	for _, pciFile := range pciFiles {
 		pciID := pciFile.Name()
+		if !FileExist(path.Join(root, pciID, MgmtFile)) {
+			continue
+		}
+		xmcFolder, err := GetFileNameFromPrefix(path.Join(root, pciID), XMCSTR)
+		if err != nil || xmcFolder == "" {
+			continue
+		}
+		sn, err := GetFileContent(path.Join(root, pciID, xmcFolder, SerialNumFile))
+		if err != nil || sn == "" {
+			continue
+		}
+		romFolder, err := GetFileNameFromPrefix(path.Join(root, pciID), ROMSTR)
+		if err != nil || romFolder == "" {
+			continue
+		}
+		vbnv, err := GetFileContent(path.Join(root, pciID, romFolder, DSAverFile))
+		if err != nil || vbnv == "" {
+			continue
+		}
+		vbnvs[sn] = vbnv
+	}
+	return vbnvs
+}
 
-		fname := path.Join(SysfsDevices, pciID, VendorFile)
-		vendorID, err := GetFileContent(fname)
-		if err != nil {
+// markVBNVMismatches degrades cards whose running user shell VBNV
+// differs from the golden side VBNV reported by the mgmt PF. Cards whose
+// mgmt side is not readable (VM passthrough etc.) are left alone.
+func markVBNVMismatches(devices map[string]Device, mgmtVBNVs map[string]string) {
+	for sn, device := range devices {
+		golden, ok := mgmtVBNVs[sn]
+		if !ok || golden == device.shellVer {
+			continue
+		}
+		device.Healthy = HealthDegraded
+		device.degradedReason = fmt.Sprintf("user VBNV %q does not match golden VBNV %q",
+			device.shellVer, golden)
+		devices[sn] = device
+		log.WithFields(log.Fields{
+			"serial": sn,
+			"reason": device.degradedReason,
+		}).Warn("Card degraded")
+	}
+}
+
+// markExpectedShellMismatches reports boards running a different shell
+// than the golden VBNV configured for their device id. Such a board is
+// withheld from scheduling entirely (unlike the softer mgmt-side VBNV
+// degrade) because in managed fleets it means the card was flashed
+// wrong, not that it is mid-update.
+func markExpectedShellMismatches(devices map[string]Device) {
+	if len(expectedShells) == 0 {
+		return
+	}
+	for sn, device := range devices {
+		if len(device.Nodes) == 0 {
 			continue
 		}
-		if strings.EqualFold(vendorID, XilinxVendorID) != true &&
-			strings.EqualFold(vendorID, AWS_ID) != true &&
-			strings.EqualFold(vendorID, ADVANTECH_ID) != true {
+		expected, ok := expectedShells[device.Nodes[0].deviceID]
+		if !ok || expected == device.shellVer {
 			continue
 		}
+		device.Healthy = pluginapi.Unhealthy
+		device.shellMismatch = true
+		devices[sn] = device
+		log.WithFields(log.Fields{
+			"serial":   sn,
+			"shell":    device.shellVer,
+			"expected": expected,
+		}).Warn("Card runs an unexpected shell; reflash it to make it schedulable")
+	}
+}
 
-		// For containers deployed either on top of baremetal machines,
-		// or deployed on top of VM, there may be only user PF assigned
-		// to vm(mgmt PF is not assigned to the VM)
-		if IsUserPf(pciID) { //user pf
-			userDBDF := pciID
-			// skip FPGAs that are not ready
-			fname = path.Join(SysfsDevices, pciID, ReadyFile)
-			content, err := GetFileContent(fname)
-			if err != nil {
-				continue
+// Device keying modes: by default cards are keyed by serial number so a
+// card's resource identity survives a re-enumeration; keying by BDF
+// instead makes each PF its own resource, for users pinning specific
+// PCIe slots.
+const (
+	deviceKeySerial = "serial"
+	deviceKeyBDF    = "bdf"
+)
+
+var deviceKeying = deviceKeySerial
+
+// shellFilter, when non-empty, restricts the advertised devices to
+// cards whose shell version matches it, either exactly or as a glob
+// pattern (path.Match syntax). Mixed clusters use this to dedicate a
+// plugin instance to one shell.
+var shellFilter string
+
+// filterShell drops devices whose shell version does not match filter.
+func filterShell(devices map[string]Device, filter string) map[string]Device {
+	if filter == "" {
+		return devices
+	}
+	for sn, device := range devices {
+		matched, err := path.Match(filter, device.shellVer)
+		if err != nil {
+			// a malformed pattern degrades to an exact match
+			matched = device.shellVer == filter
+		}
+		if !matched {
+			logger.Infof("Skipping card %s: shell %s does not match filter %s",
+				sn, device.shellVer, filter)
+			delete(devices, sn)
+		}
+	}
+	return devices
+}
+
+// devNodePresent is how discovery checks that a constructed /dev path
+// actually exists. A variable so tests running against a fake sysfs
+// tree, with no matching /dev nodes, can stub it out.
+var devNodePresent = FileExist
+
+// filterMissingDevNodes drops cards whose constructed device nodes do
+// not exist yet, typically because udev has not created them right
+// after a driver load. Advertising such a card would make its Allocate
+// mount a nonexistent path and fail the pod; skipping it lets the card
+// appear on a later scan once udev catches up. The individual subdev
+// nodes are enumerated from /dev and exist by construction, so only
+// the paths derived from sysfs names are checked.
+func filterMissingDevNodes(devices map[string]Device) map[string]Device {
+	for sn, device := range devices {
+		if missing := missingDevNode(device); missing != "" {
+			logger.Warnf("Skipping card %s: device node %s not present yet, retrying next scan", sn, missing)
+			delete(devices, sn)
+		}
+	}
+	return devices
+}
+
+// missingDevNode returns the first constructed node path of the device
+// that does not exist, empty when all are present.
+func missingDevNode(device Device) string {
+	for _, node := range device.Nodes {
+		for _, fname := range []string{node.User, node.Qdma, node.SubdevPath} {
+			if fname != "" && !devNodePresent(fname) {
+				return fname
 			}
-			if strings.Compare(content, FPGAReady) != 0 {
-				continue
+		}
+	}
+	return ""
+}
+
+// filterRequireMgmt drops devices with no visible mgmt PF. A card
+// passes either by serial, when some mgmt PF reported the same serial
+// number, or by bus siblinghood, when a function on the card's own
+// domain:bus carries the mgmt_pf marker. The sibling check keeps cards
+// whose mgmt PF is present but has an unreadable serial, and cards
+// keyed by BDF, from being dropped spuriously.
+func filterRequireMgmt(devices map[string]Device, mgmtSerials map[string]bool) map[string]Device {
+	for sn, device := range devices {
+		if mgmtSerials[sn] || hasMgmtSibling(device) {
+			continue
+		}
+		logger.Infof("Skipping card %s: no mgmt PF visible and require-mgmt is set", sn)
+		delete(devices, sn)
+	}
+	return devices
+}
+
+// hasMgmtSibling reports whether any function on the same domain:bus
+// as one of the device's nodes is a mgmt PF.
+func hasMgmtSibling(device Device) bool {
+	for _, node := range device.Nodes {
+		idx := strings.LastIndex(node.DBDF, ":")
+		if idx < 0 {
+			continue
+		}
+		busPrefix := node.DBDF[:idx+1] // e.g. "0000:65:"
+		pciIDs, err := locator.DeviceIDs()
+		if err != nil {
+			return false
+		}
+		for _, pciID := range pciIDs {
+			if strings.HasPrefix(pciID, busPrefix) && IsMgmtPf(pciID) {
+				return true
 			}
-			// get SN
-			xmcFolder, err := GetFileNameFromPrefix(path.Join(SysfsDevices, pciID), XMCSTR)
-			if err != nil {
-				continue
+		}
+	}
+	return false
+}
+
+func IsUserPf(pciID string) bool {
+	fname := path.Join(locator.DeviceDir(pciID), UserFile)
+	return FileExist(fname)
+}
+
+// GetVirtualFunctions returns the BDFs of the SR-IOV virtual functions
+// spawned by the PF at devDir, in virtfn index order. The kernel exposes
+// one virtfn<N> symlink per enabled VF, each pointing at the VF's own
+// sysfs directory; boards without SR-IOV enabled have none.
+func GetVirtualFunctions(devDir string) []string {
+	var vfs []string
+	for i := 0; ; i++ {
+		link := path.Join(devDir, fmt.Sprintf("virtfn%d", i))
+		target, err := os.Readlink(link)
+		if err != nil {
+			break
+		}
+		vfs = append(vfs, path.Base(target))
+	}
+	return vfs
+}
+
+// enumerateSubdevNodes lists dir once and groups the subdevice nodes by
+// the instance number encoded in their name (e.g. dma.qdma.u256 belongs
+// to instance 256). Enumerating once per scan keeps Allocate fast even
+// on hosts with a dense /dev/xfpga.
+func enumerateSubdevNodes(dir string) map[string][]string {
+	nodes := make(map[string][]string)
+	files, err := fsys.ReadDir(dir)
+	if err != nil {
+		// no subdev directory on this host
+		return nodes
+	}
+	for _, file := range files {
+		fname := file.Name()
+		idx := strings.LastIndex(fname, ".u")
+		if idx < 0 {
+			continue
+		}
+		instance := fname[idx+2:]
+		if _, err := strconv.ParseUint(instance, 10, 64); err != nil {
+			continue
+		}
+		nodes[instance] = append(nodes[instance], path.Join(dir, fname))
+	}
+	return nodes
+}
+
+// selectRenderNode returns the render node name under dir. Certain
+// shells expose more than one renderD* entry; the lowest numeric suffix
+// is chosen so the pick is deterministic between scans, with a warning
+// because which node drives the FPGA is then ambiguous.
+func selectRenderNode(dir string) (string, error) {
+	names, err := GetFileNamesFromPrefix(dir, DRMSTR)
+	if err != nil {
+		return "", err
+	}
+	best := ""
+	var bestNum uint64
+	for _, name := range names {
+		num, err := strconv.ParseUint(strings.TrimPrefix(name, DRMSTR), 10, 64)
+		if err != nil {
+			continue
+		}
+		if best == "" || num < bestNum {
+			best, bestNum = name, num
+		}
+	}
+	// entries with a malformed suffix only win when nothing parses
+	if best == "" && len(names) > 0 {
+		best = names[0]
+	}
+	// a drm directory holding only card* entries must not turn into a
+	// bare /dev/dri path with an empty filename downstream
+	if best == "" {
+		return "", fmt.Errorf("no %s* node under %s", DRMSTR, dir)
+	}
+	if len(names) > 1 {
+		logger.Warnf("%s holds %d render nodes %v, using %s", dir, len(names), names, best)
+	}
+	return best, nil
+}
+
+// resolveQdmaNodes cross-checks the computed QDMA node paths against
+// the nodes actually present under /dev/xfpga. A computed path that
+// exists is kept as-is; one that doesn't is replaced when the host has
+// exactly one real QDMA node to offer, otherwise kept with a warning so
+// the operator sees why Allocate may fail. With no visible nodes at all
+// (e.g. /dev/xfpga not mounted into this container) the computed values
+// pass through unchecked.
+func resolveQdmaNodes(computed, present []string) []string {
+	if len(computed) == 0 || len(present) == 0 {
+		return computed
+	}
+	presentSet := make(map[string]bool, len(present))
+	for _, node := range present {
+		presentSet[node] = true
+	}
+	seen := make(map[string]bool, len(computed))
+	var resolved []string
+	for _, candidate := range computed {
+		node := candidate
+		if !presentSet[candidate] {
+			if len(present) == 1 {
+				logger.Warnf("QDMA node %s does not exist, using %s created by the driver instead",
+					candidate, present[0])
+				node = present[0]
+			} else {
+				logger.Warnf("QDMA node %s does not exist and %d other candidates are present, keeping the computed path",
+					candidate, len(present))
 			}
-			fname = path.Join(SysfsDevices, pciID, xmcFolder, SerialNumFile)
+		}
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		resolved = append(resolved, node)
+	}
+	return resolved
+}
+
+// discoveryConcurrency bounds how many PCI functions are probed at
+// once during a scan. Sysfs reads block, so a serial walk on a host
+// with many boards delays health updates; unbounded goroutines
+// hammering sysfs regress just as badly. 1 restores the serial walk.
+var discoveryConcurrency = 4
+
+// deviceProbe is the result of probing one PCI function. Probes run
+// concurrently, so everything order-dependent (AWS slot numbering,
+// serial-collision keying) is deferred to the serial merge in
+// GetDevicesContext.
+type deviceProbe struct {
+	pciID string
+	diags []DeviceError
+	// awsUser marks an F1 application PF; its Device is built in the
+	// merge, where the slot number is assigned
+	awsUser bool
+	// isMgmt marks a mgmt PF; mgmtSerial carries its serial when
+	// readable
+	isMgmt     bool
+	mgmtSerial string
+	// device is a discovered user PF still keyed by its raw serial sn;
+	// the merge settles the final map key
+	device *Device
+	sn     string
+}
+
+// serialFromBoardInfo extracts the serial number from a combined
+// board_info attribute, whose lines look like "Serial Num: XYZ".
+// Key matching is case-insensitive and tolerates the space, underscore
+// and abbreviated spellings seen across shell releases. Empty means no
+// serial was found.
+func serialFromBoardInfo(fname string) string {
+	content, err := GetFileContentBounded(fname, maxAttrSize)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(content, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(parts[0])), " ", "_")
+		switch key {
+		case "serial_num", "serial_number", "serial", "sn":
+			return strings.TrimSpace(parts[1])
+		}
+	}
+	return ""
+}
+
+// serialFallback is tried when the layout's serial_num attribute is
+// absent or empty: newer shells dropped the standalone file and fold
+// the serial into a board_info blob, under the XMC folder or flat in
+// the device directory. The winning source is logged so operators can
+// tell where a serial came from. Empty means every source came up
+// empty; the caller then keys the card by BDF.
+func serialFallback(pciID, devDir string) string {
+	candidates := []string{path.Join(devDir, BoardInfoFile)}
+	if xmcFolder, err := GetFileNameFromPrefix(devDir, XMCSTR); err == nil && xmcFolder != "" {
+		candidates = append([]string{path.Join(devDir, xmcFolder, BoardInfoFile)}, candidates...)
+	}
+	for _, fname := range candidates {
+		if sn := serialFromBoardInfo(fname); sn != "" {
+			logger.Infof("Card %s: serial %s read from %s (no standalone %s)",
+				pciID, sn, fname, SerialNumFile)
+			return sn
+		}
+	}
+	return ""
+}
+
+// probeDevice inspects one PCI function: the vendor and class gates,
+// then the full metadata walk for user PFs. It must not touch shared
+// scan state; everything it learns travels back in the returned probe.
+func probeDevice(pciID string, subdevNodes map[string][]string) *deviceProbe {
+	probe := &deviceProbe{pciID: pciID}
+	devDir := locator.DeviceDir(pciID)
+
+	if len(includeBDFs) > 0 && !includeBDFs[strings.ToLower(pciID)] {
+		logger.Debugf("Card %s is not in the include-bdfs allowlist, skipping", pciID)
+		return probe
+	}
+
+	fname := path.Join(devDir, VendorFile)
+	vendorID, err := GetFileContent(fname)
+	if err != nil {
+		probe.diags = append(probe.diags, DeviceError{pciID, "vendor unreadable", err})
+		return probe
+	}
+	if !isKnownVendor(vendorID) {
+		logger.Debugf("Device %s has foreign vendor %s, skipping", pciID, vendorID)
+		return probe
+	}
+	// a PCIe switch in front of the board reports the board vendor's
+	// ID on some platforms; only the endpoint functions behind it are
+	// devices
+	if isPCIBridge(devDir) {
+		logger.Debugf("Device %s is a PCI bridge, skipping", pciID)
+		return probe
+	}
+
+	// AWS F1 has neither the user_pf marker nor the XMC/ROM
+	// subdevs; its slots are discovered separately. The slot number
+	// is assigned in the merge, in sorted BDF order.
+	if strings.EqualFold(vendorID, AWS_ID) {
+		fname = path.Join(devDir, DeviceFile)
+		devid, err := GetFileContent(fname)
+		if err != nil {
+			probe.diags = append(probe.diags, DeviceError{pciID, "device id unreadable", err})
+			return probe
+		}
+		if strings.EqualFold(devid, AWSF1MgmtDevID) {
+			logger.Debugf("Device %s is the F1 management PF, skipping", pciID)
+			return probe
+		}
+		// AWS has non-FPGA functions (ENA etc.) under the same
+		// vendor id; only the F1 application PF is a slot
+		if strings.EqualFold(devid, AWSF1UserDevID) != true {
+			logger.Debugf("Device %s is AWS but not an F1 application PF (%s), skipping",
+				pciID, devid)
+			return probe
+		}
+		probe.awsUser = true
+		return probe
+	}
+
+	// For containers deployed either on top of baremetal machines,
+	// or deployed on top of VM, there may be only user PF assigned
+	// to vm(mgmt PF is not assigned to the VM)
+	if IsUserPf(pciID) { //user pf
+		userDBDF := pciID
+		fname = path.Join(devDir, ReadyFile)
+		content, err := GetFileContent(fname)
+		// during the boot window a missing or still-0x0 ready attribute
+		// gets a bounded re-poll before being believed: the attribute
+		// appears a moment after the driver binds
+		for attempt := 0; inBootWindow() && attempt < bootRetries &&
+			(err != nil || strings.Compare(content, FPGAReady) != 0); attempt++ {
+			logger.Infof("Card %s not ready yet, re-polling in %v (boot window, attempt %d/%d)",
+				pciID, bootRetryDelay, attempt+1, bootRetries)
+			time.Sleep(bootRetryDelay)
+			forgetCachedFile(fname)
 			content, err = GetFileContent(fname)
-			if err != nil {
-				continue
+		}
+		if err != nil {
+			probe.diags = append(probe.diags, DeviceError{pciID, ReadyFile + " unreadable", err})
+			return probe
+		}
+		// HBM shells (U50/U55C) flip ready only after ECC init
+		// completes, so a present-but-initializing card is normal.
+		// It is advertised Unhealthy instead of omitted, and turns
+		// healthy on the first scan after ready reads 0x1.
+		cardReady := strings.Compare(content, FPGAReady) == 0
+		if !cardReady {
+			probe.diags = append(probe.diags, DeviceError{pciID, "shell not ready", nil})
+		}
+		// resolve where this driver version keeps the metadata.
+		// Metadata is optional: a board whose serial, VBNV or
+		// timestamp can't be read right now (e.g. mid-FLR) is still
+		// advertised, with the field left blank, instead of
+		// vanishing from the cluster for a scan.
+		layout, err := resolveLayout(devDir, vendorID)
+		if err != nil {
+			logger.Warnf("Card %s has no known sysfs layout; advertising with blank metadata: %v", pciID, err)
+			layout = &resolvedLayout{qdmaPrefix: QDMASTR}
+		}
+		readOptional := func(file, what string) string {
+			if file == "" {
+				return ""
 			}
-			sn := content
-			// get dsa version
-			romFolder, err := GetFileNameFromPrefix(path.Join(SysfsDevices, pciID), ROMSTR)
-			if err != nil {
-				continue
+			content, err := GetFileContent(file)
+			// metadata attributes can lag the driver bind at boot;
+			// re-poll within the boot window instead of blanking them
+			for attempt := 0; err != nil && inBootWindow() && attempt < bootRetries; attempt++ {
+				time.Sleep(bootRetryDelay)
+				content, err = GetFileContent(file)
 			}
-			fname = path.Join(SysfsDevices, pciID, romFolder, DSAverFile)
-			content, err = GetFileContent(fname)
 			if err != nil {
-				continue
+				// an absent optional attribute is normal on older
+				// shells; only real I/O errors deserve a warning
+				if errors.Is(err, os.ErrNotExist) {
+					logger.Debugf("Card %s: %s not present, leaving it blank", pciID, what)
+				} else {
+					logger.Warnf("Card %s: %s unreadable, leaving it blank: %v", pciID, what, err)
+				}
+				return ""
 			}
-			dsaVer := content
-			// get dsa timestamp
-			fname = path.Join(SysfsDevices, pciID, romFolder, DSAtsFile)
-			content, err = GetFileContent(fname)
-			if err != nil {
-				continue
+			return content
+		}
+		sn := readOptional(layout.serialPath, SerialNumFile)
+		if sn != "" {
+			logger.Debugf("Card %s: serial from %s", pciID, layout.serialPath)
+		} else {
+			sn = serialFallback(pciID, devDir)
+		}
+		dsaVer := readOptional(layout.vbnvPath, DSAverFile)
+		dsaTs := readOptional(layout.timestampPath, DSAtsFile)
+		// parse the timestamp for numeric policies; cards with an
+		// unparseable timestamp keep the raw string and simply skip
+		// those policies
+		tsValue, err := ParseTimestamp(dsaTs)
+		if err != nil {
+			logger.Debugf("Card %s has unparseable timestamp %q: %v", pciID, dsaTs, err)
+			tsValue = 0
+		}
+		if min, ok := minTimestamps[dsaVer]; ok && tsValue != 0 && tsValue < min {
+			log.WithFields(log.Fields{
+				"bdf":    pciID,
+				"shell":  dsaVer,
+				"reason": fmt.Sprintf("timestamp %d older than required %d", tsValue, min),
+			}).Info("Skipping card")
+			return probe
+		}
+		// get loaded xclbin UUID, if any
+		xclbinUUID := GetXclbinUUID(pciID)
+		cuCount := GetCUCount(pciID)
+		if expected, ok := expectedXclbins[dsaVer]; ok &&
+			!strings.EqualFold(xclbinUUID, expected) {
+			logger.Warnf("Card %s has xclbin %q loaded, expected %q for shell %s",
+				pciID, xclbinUUID, expected, dsaVer)
+		}
+		// get device id, also optional
+		devid := readOptional(path.Join(devDir, DeviceFile), "device id")
+		// get user PF node
+		userpf, err := selectRenderNode(path.Join(devDir, UserPFKeyword))
+		if err != nil {
+			probe.diags = append(probe.diags, DeviceError{pciID, "render node not found", err})
+			return probe
+		}
+		userNode := path.Join(UserPrefix, userpf)
+
+		topo := getTopology(pciID)
+		node := Node{
+			DBDF:         userDBDF,
+			deviceID:     devid,
+			User:         userNode,
+			SubdevPath:   SubdevPrefix,
+			Qdma:         "",
+			NUMA:         topo.NUMANode,
+			ParentSwitch: topo.ParentSwitch,
+		}
+
+		//get qdma device node if it exists
+		instance, err := GetInstance(userDBDF)
+		if err != nil {
+			probe.diags = append(probe.diags, DeviceError{pciID, "BDF unparseable", err})
+			return probe
+		}
+		node.SubdevNodes = subdevNodes[instance]
+		node.ExtraDevices = expandExtraDevices(dsaVer)
+
+		qdmaFolders, err := GetFileNamesFromPrefix(devDir, layout.qdmaPrefix)
+		if err != nil {
+			probe.diags = append(probe.diags, DeviceError{pciID, "qdma lookup failed", err})
+			return probe
+		}
+
+		// each QDMA folder carries its own instance suffix after
+		// ".u"; a multi-queue card exposes one node per queue. The
+		// suffix is authoritative: some shells key the QDMA off the
+		// mgmt PF's BDF, so recomputing it from the user PF's BDF
+		// would point at a node that doesn't exist
+		for _, folder := range qdmaFolders {
+			if idx := strings.LastIndex(folder, ".u"); idx >= 0 {
+				node.Qdmas = append(node.Qdmas,
+					path.Join(SubdevPrefix, layout.qdmaPrefix+folder[idx+2:]))
 			}
-			dsaTs := content
-			// get device id
-			fname = path.Join(SysfsDevices, pciID, DeviceFile)
-			content, err = GetFileContent(fname)
-			if err != nil {
-				continue
+		}
+		sort.Strings(node.Qdmas)
+		// some driver versions pick a different instance suffix
+		// than the BDF arithmetic predicts; trust what it actually
+		// created under /dev/xfpga over the computed path
+		var presentQdmas []string
+		for _, subdevs := range subdevNodes {
+			for _, subdev := range subdevs {
+				if strings.HasPrefix(path.Base(subdev), layout.qdmaPrefix) {
+					presentQdmas = append(presentQdmas, subdev)
+				}
 			}
-			devid := content
-			// get user PF node
-			userpf, err := GetFileNameFromPrefix(path.Join(SysfsDevices, pciID, UserPFKeyword), DRMSTR)
+		}
+		sort.Strings(presentQdmas)
+		node.Qdmas = resolveQdmaNodes(node.Qdmas, presentQdmas)
+		if len(node.Qdmas) > 0 {
+			node.Qdma = node.Qdmas[0]
+		}
+
+		nodes := []Node{node}
+		// in SR-IOV mode the PF spawns virtual functions, each an
+		// allocatable node of its own; they inherit the PF serial
+		// so a card's VFs group under one Device
+		for _, vfDBDF := range GetVirtualFunctions(devDir) {
+			vfDir := locator.DeviceDir(vfDBDF)
+			vfpf, err := selectRenderNode(path.Join(vfDir, UserPFKeyword))
 			if err != nil {
+				probe.diags = append(probe.diags, DeviceError{vfDBDF, "render node not found", err})
 				continue
 			}
-			userNode := path.Join(UserPrefix, userpf)
-
-			node := Node{
-				DBDF:       userDBDF,
-				deviceID:   devid,
-				User:       userNode,
-				SubdevPath: SubdevPrefix,
-				Qdma:       "",
-			}
-
-			//get qdma device node if it exists
-			instance, err := GetInstance(userDBDF)
+			vfInstance, err := GetInstance(vfDBDF)
 			if err != nil {
+				probe.diags = append(probe.diags, DeviceError{vfDBDF, "BDF unparseable", err})
 				continue
 			}
+			vfTopo := getTopology(vfDBDF)
+			nodes = append(nodes, Node{
+				DBDF:         vfDBDF,
+				deviceID:     devid,
+				User:         path.Join(UserPrefix, vfpf),
+				SubdevPath:   SubdevPrefix,
+				SubdevNodes:  subdevNodes[vfInstance],
+				NUMA:         vfTopo.NUMANode,
+				ParentSwitch: vfTopo.ParentSwitch,
+			})
+		}
 
-			qdmaFolder, err := GetFileNameFromPrefix(path.Join(SysfsDevices, pciID), QDMASTR)
-			if err != nil {
-				continue
+		// keep the parsed shell components alongside the raw string;
+		// non-conforming VBNVs just leave them blank
+		parsedVBNV, _ := ParseVBNV(dsaVer)
+		probe.sn = sn
+		probe.device = &Device{
+			sn:             sn,
+			shellVer:       dsaVer,
+			vbnv:           parsedVBNV,
+			timestamp:      dsaTs,
+			tsValue:        tsValue,
+			xclbinUUID:     xclbinUUID,
+			cuCount:        cuCount,
+			recoveryAction: GetRecoveryAction(pciID),
+			temp:           GetTemperature(pciID),
+			powerProfile:   GetPowerProfile(pciID),
+			clockFreqs:     GetClockFreqs(pciID),
+			Healthy:        pluginapi.Healthy,
+			Nodes:          nodes,
+		}
+		// the checker chain sees the fully assembled device; a card
+		// whose shell is not ready is unhealthy regardless of verdict
+		healthy := runHealthCheckers(probe.device)
+		if !cardReady {
+			healthy = pluginapi.Unhealthy
+		}
+		probe.device.Healthy = healthy
+	} else if IsMgmtPf(pciID) {
+		// a mgmt PF contributes no allocatable device itself; its
+		// serial is noted so boards whose user PF went to a VM
+		// elsewhere show up in the diagnostics count below
+		logger.Debugf("Device %s is a mgmt PF, not advertised", pciID)
+		probe.isMgmt = true
+		if xmcFolder, err := GetFileNameFromPrefix(devDir, XMCSTR); err == nil && xmcFolder != "" {
+			if serial, err := GetFileContent(path.Join(devDir, xmcFolder, SerialNumFile)); err == nil {
+				probe.mgmtSerial = serial
 			}
+		}
+	} else {
+		logger.Debugf("Device %s is neither user nor mgmt PF, skipping", pciID)
+	}
+	return probe
+}
 
-			if qdmaFolder != "" {
-				node.Qdma = path.Join(SubdevPrefix, QDMASTR+instance)
+// GetDevices walks the PCI bus and returns the discovered cards plus
+// per-device diagnostics for every card that was skipped along the way.
+// The happy-path map semantics are unchanged.
+// GetDevices walks sysfs and returns the discovered devices. It is
+// GetDevicesContext without cancellation, for callers with no context.
+func GetDevices() (map[string]Device, []DeviceError, error) {
+	return GetDevicesContext(context.Background())
+}
+
+// UnknownResourceBucket is the resource bucket for boards whose shell
+// version could not be read, so they group somewhere visible instead of
+// under a hash of an empty name.
+// listPCIDevices wraps locator.DeviceIDs with the error classification
+// every scan entry point shares: a PCI tree that is missing outright is
+// a node misconfiguration, not an empty node — the plugin can't see any
+// hardware and never will until the mount is fixed.
+func listPCIDevices() ([]string, error) {
+	pciIDs, err := locator.DeviceIDs()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf(
+				"No PCI sysfs at %s: mount the host /sys into the container (or point -sysfs-root at it)",
+				SysfsDevices)
+		}
+		return nil, fmt.Errorf("Can't read folder %s", SysfsDevices)
+	}
+	return pciIDs, nil
+}
+
+const UnknownResourceBucket = "unknown"
+
+// GetDevicesByResourceName runs discovery and buckets the devices by
+// the resource name suffix they will be advertised under, the natural
+// input on nodes hosting several FPGA models. Boards with a blank
+// shell version land in UnknownResourceBucket rather than being
+// dropped. Each bucket is sorted by serial number so repeated calls
+// return the devices in a stable order.
+func GetDevicesByResourceName() (map[string][]Device, error) {
+	devices, _, err := ScanDevices()
+	if err != nil {
+		return nil, err
+	}
+	buckets := make(map[string][]Device)
+	for _, device := range devices {
+		name := UnknownResourceBucket
+		if device.shellVer != "" {
+			name = resourceNameOf(device)
+		}
+		buckets[name] = append(buckets[name], device)
+	}
+	for _, bucket := range buckets {
+		sort.Slice(bucket, func(i, j int) bool { return bucket[i].sn < bucket[j].sn })
+	}
+	return buckets, nil
+}
+
+// ResolveDeviceIdentity maps a device node path (e.g.
+// /dev/dri/renderD128) or a raw BDF back to the discovered board that
+// owns it, for correlating a node a pod was allocated with physical
+// hardware. BDFs compare case-insensitively; paths compare exactly, and
+// the user, subdev, QDMA and extra nodes of a card all count as its
+// nodes.
+func ResolveDeviceIdentity(nodePathOrBDF string) (Device, Node, error) {
+	devices, _, err := ScanDevices()
+	if err != nil {
+		return Device{}, Node{}, err
+	}
+	for _, device := range devices {
+		for _, node := range device.Nodes {
+			if nodeOwns(node, nodePathOrBDF) {
+				return device, node, nil
 			}
+		}
+	}
+	return Device{}, Node{}, fmt.Errorf("no discovered device owns %q", nodePathOrBDF)
+}
 
-			//TODO: check temp, power, fan speed etc, to give a healthy level
-			//so far, return Healthy
-			healthy := pluginapi.Healthy
+// nodeOwns reports whether id names this node, either as its BDF or as
+// one of its device node paths.
+func nodeOwns(node Node, id string) bool {
+	if node.DBDF != "" && strings.EqualFold(node.DBDF, id) {
+		return true
+	}
+	paths := []string{node.User, node.Qdma}
+	paths = append(paths, node.SubdevNodes...)
+	paths = append(paths, node.Qdmas...)
+	paths = append(paths, node.ExtraDevices...)
+	for _, p := range paths {
+		if p != "" && p == id {
+			return true
+		}
+	}
+	return false
+}
 
-			if _, ok := devices[sn]; ok {
-				device := devices[sn]
-				nodes := device.Nodes
-				nodes = append(nodes, node)
-				device.Nodes = nodes
-				devices[sn] = device
-			} else {
-				devices[sn] = Device{
-					sn:        sn,
-					shellVer:  dsaVer,
-					timestamp: dsaTs,
-					Healthy:   healthy,
-					Nodes:     []Node{node},
+// GetDevicesContext is GetDevices with cooperative cancellation: the
+// context is checked between PCI device iterations, so a shutdown
+// doesn't have to wait out a full walk on nodes with many boards and
+// slow sysfs.
+func GetDevicesContext(ctx context.Context) (map[string]Device, []DeviceError, error) {
+	devices := make(map[string]Device)
+	var diags []DeviceError
+	start := time.Now()
+	defer func() { observeDiscoveryDuration(time.Since(start)) }()
+	// memoize repeated sysfs reads for the duration of this scan
+	defer beginScanCache()()
+	pciIDs, err := listPCIDevices()
+	if err != nil {
+		return nil, nil, err
+	}
+	subdevNodes := enumerateSubdevNodes(SubdevPrefix)
+	// re-derive topology when the device set changed, e.g. on hotplug
+	syncTopologyCache(pciIDs)
+	awsSlot := 0
+	// which PCI ID first claimed each serial, to name both parties when
+	// a clone is detected
+	serialOwners := make(map[string]string)
+	var mgmtSerialsSeen []string
+
+	// probe every function in parallel through a bounded worker pool,
+	// then merge serially in sorted BDF order so the order-dependent
+	// decisions stay deterministic
+	probes := make([]*deviceProbe, len(pciIDs))
+	workers := discoveryConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(pciIDs) {
+		workers = len(pciIDs)
+	}
+	var wg sync.WaitGroup
+	indexes := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if ctx.Err() != nil {
+					continue
 				}
+				probes[i] = probeDevice(pciIDs[i], subdevNodes)
 			}
+		}()
+	}
+	for i := range pciIDs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, diags, err
+	}
+
+	for _, probe := range probes {
+		if probe == nil {
+			continue
+		}
+		diags = append(diags, probe.diags...)
+		switch {
+		case probe.isMgmt:
+			if probe.mgmtSerial != "" {
+				mgmtSerialsSeen = append(mgmtSerialsSeen, probe.mgmtSerial)
+			}
+		case probe.awsUser:
+			device := getAWSF1Device(probe.pciID, awsSlot)
+			awsSlot++
+			devices[device.sn] = device
+			logger.Infof("Discovered AWS F1 slot %d: %s", awsSlot-1, probe.pciID)
+		case probe.device != nil:
+			// early or cloned boards sometimes report an empty or
+			// duplicated serial number; keying two physical cards by
+			// the same serial would merge them and corrupt allocation,
+			// so fall back to the BDF for those
+			sn := probe.sn
+			key := sn
+			if deviceKeying == deviceKeyBDF {
+				key = probe.pciID
+			} else if sn == "" {
+				key = probe.pciID
+				logger.Warnf("Card %s reports an empty serial number; keying it by BDF", probe.pciID)
+			} else if owner, ok := serialOwners[sn]; ok {
+				key = probe.pciID
+				logger.Warnf("Cards %s and %s both report serial number %s; keying %s by BDF",
+					owner, probe.pciID, sn, probe.pciID)
+				diags = append(diags, DeviceError{probe.pciID, "duplicate serial",
+					fmt.Errorf("serial %s already reported by %s", sn, owner)})
+			} else {
+				serialOwners[sn] = probe.pciID
+			}
+			device := *probe.device
+			device.sn = key
+			devices[key] = device
+			logger.Infof("Discovered card %s: serial %s, shell %s, health %s",
+				probe.pciID, key, device.shellVer, device.Healthy)
 		}
 	}
-	return devices, nil
+	// mgmt-only boards: the mgmt PF is here but the user PF is not,
+	// typically because it is passed through to a VM
+	mgmtOnly := 0
+	for _, serial := range mgmtSerialsSeen {
+		if _, ok := devices[serial]; !ok {
+			mgmtOnly++
+		}
+	}
+	if mgmtOnly > 0 {
+		logger.Infof("%d board(s) show only their mgmt PF on this host; their user PF is not visible", mgmtOnly)
+	}
+	devices = filterMissingDevNodes(devices)
+	if requireMgmtPF {
+		devices = filterRequireMgmt(devices, getMgmtSerials(SysfsDevices))
+	}
+	devices = filterShell(devices, shellFilter)
+	for _, diag := range diags {
+		logger.Warnf("%s", diag.Error())
+	}
+	markVBNVMismatches(devices, getMgmtVBNVs(SysfsDevices))
+	markExpectedShellMismatches(devices)
+	// the boot window ends with the first completed scan; later rescans
+	// take the fast non-retrying path
+	atomic.StoreUint32(&firstScanDone, 1)
+	return devices, diags, nil
 }
 
 /*
@@ -0,0 +1,1522 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+// makeSubdevDir populates dir with subdev nodes for n instances, a few
+// nodes each, mimicking a dense /dev/xfpga.
+func makeSubdevDir(tb testing.TB, dir string, n int) {
+	tb.Helper()
+	for i := 0; i < n; i++ {
+		for _, subdev := range []string{"dma.qdma.u", "xvc_pub.u", "mailbox.u"} {
+			fname := path.Join(dir, fmt.Sprintf("%s%d", subdev, 256*(i+1)))
+			if err := ioutil.WriteFile(fname, nil, 0644); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestEnumerateSubdevNodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xfpga")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	makeSubdevDir(t, dir, 8)
+
+	nodes := enumerateSubdevNodes(dir)
+	if len(nodes) != 8 {
+		t.Fatalf("expected 8 instances, got %d", len(nodes))
+	}
+	// each instance must see only its own nodes
+	for instance, paths := range nodes {
+		if len(paths) != 3 {
+			t.Errorf("instance %s: expected 3 nodes, got %v", instance, paths)
+		}
+		for _, p := range paths {
+			if want := ".u" + instance; p[len(p)-len(want):] != want {
+				t.Errorf("instance %s: foreign node %s", instance, p)
+			}
+		}
+	}
+}
+
+func TestEnumerateSubdevNodesMissingDir(t *testing.T) {
+	nodes := enumerateSubdevNodes("/nonexistent/xfpga")
+	if len(nodes) != 0 {
+		t.Errorf("expected no nodes, got %v", nodes)
+	}
+}
+
+func TestGetFileContentBounded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "attr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	small := path.Join(dir, "small")
+	if err := ioutil.WriteFile(small, []byte("value\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	content, err := GetFileContentBounded(small, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "value" {
+		t.Errorf("got %q, want %q", content, "value")
+	}
+
+	// an attribute exactly at the limit is fine
+	exact := path.Join(dir, "exact")
+	if err := ioutil.WriteFile(exact, make([]byte, 64), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetFileContentBounded(exact, 64); err != nil {
+		t.Errorf("attribute at the limit rejected: %v", err)
+	}
+
+	// an oversized attribute is refused with a clear error
+	big := path.Join(dir, "big")
+	if err := ioutil.WriteFile(big, make([]byte, 65), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetFileContentBounded(big, 64); err == nil {
+		t.Error("oversized attribute not rejected")
+	}
+}
+
+func TestGetFileContentRetry(t *testing.T) {
+	dir := t.TempDir()
+
+	// a genuinely missing file fails immediately, without the backoff
+	start := time.Now()
+	if _, err := GetFileContent(path.Join(dir, "gone")); err == nil {
+		t.Fatal("read of a missing file succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > readRetryDelay {
+		t.Errorf("missing file was retried, took %v", elapsed)
+	}
+
+	// a transient error (here a symlink loop standing in for EIO during
+	// FLR) is retried; the file becoming readable in time succeeds
+	loop := path.Join(dir, "attr")
+	if err := os.Symlink(loop, loop); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(readRetryDelay / 2)
+		os.Remove(loop)
+		ioutil.WriteFile(loop, []byte("value\n"), 0644)
+	}()
+	content, err := GetFileContent(loop)
+	if err != nil {
+		t.Fatalf("transient failure not retried: %v", err)
+	}
+	if content != "value" {
+		t.Errorf("got %q, want %q", content, "value")
+	}
+}
+
+func TestGetFileContentErrorKinds(t *testing.T) {
+	dir := t.TempDir()
+
+	// absence is distinguishable so callers can treat optional
+	// attributes as non-fatal
+	_, err := GetFileContent(path.Join(dir, "absent"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file error %v does not unwrap to os.ErrNotExist", err)
+	}
+
+	// a permission error is a real I/O problem, not absence
+	if os.Geteuid() != 0 {
+		locked := path.Join(dir, "locked")
+		if err := ioutil.WriteFile(locked, []byte("x\n"), 0000); err != nil {
+			t.Fatal(err)
+		}
+		_, err := GetFileContent(locked)
+		if err == nil {
+			t.Fatal("unreadable file read succeeded")
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			t.Errorf("permission error %v misreported as absence", err)
+		}
+		if !errors.Is(err, os.ErrPermission) {
+			t.Errorf("error %v does not unwrap to os.ErrPermission", err)
+		}
+	}
+}
+
+func TestRequireMgmt(t *testing.T) {
+	root, err := ioutil.TempDir("", "pci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// a mgmt PF for serial A only
+	mgmtDir := path.Join(root, "0000:65:00.0", "xmc.u1")
+	if err := os.MkdirAll(mgmtDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(root, "0000:65:00.0", MgmtFile), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(mgmtDir, SerialNumFile), []byte("serialA\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	serials := getMgmtSerials(root)
+	if !serials["serialA"] || len(serials) != 1 {
+		t.Fatalf("expected only serialA, got %v", serials)
+	}
+
+	devices := map[string]Device{
+		"serialA": {sn: "serialA"},
+		"serialB": {sn: "serialB"},
+	}
+	filtered := filterRequireMgmt(devices, serials)
+	if _, ok := filtered["serialA"]; !ok {
+		t.Error("serialA should survive require-mgmt filtering")
+	}
+	if _, ok := filtered["serialB"]; ok {
+		t.Error("serialB has no mgmt PF and should be filtered")
+	}
+}
+
+// A mgmt PF whose serial attribute can't be read still counts: the card
+// passes require-mgmt when a function on its own domain:bus carries the
+// mgmt_pf marker.
+func TestRequireMgmtBDFSibling(t *testing.T) {
+	defer func() { locator = pciLocator{root: SysfsDevices} }()
+	root := t.TempDir()
+	locator = pciLocator{root: root}
+
+	// a mgmt PF with the marker but no readable serial
+	for _, pciID := range []string{"0000:65:00.0", "0000:65:00.1", "0000:81:00.1"} {
+		if err := os.MkdirAll(path.Join(root, pciID), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(root, "0000:65:00.0", MgmtFile), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	devices := map[string]Device{
+		"0000:65:00.1": {sn: "0000:65:00.1",
+			Nodes: []Node{{DBDF: "0000:65:00.1"}}},
+		"0000:81:00.1": {sn: "0000:81:00.1",
+			Nodes: []Node{{DBDF: "0000:81:00.1"}}},
+	}
+	filtered := filterRequireMgmt(devices, getMgmtSerials(root))
+	if _, ok := filtered["0000:65:00.1"]; !ok {
+		t.Error("card with a mgmt PF sibling on its bus should survive require-mgmt")
+	}
+	if _, ok := filtered["0000:81:00.1"]; ok {
+		t.Error("card with no mgmt PF on its bus should be filtered")
+	}
+}
+
+// A card whose constructed /dev nodes do not exist yet (udev lag after
+// a driver load) is withheld from advertising and picked up on a later
+// scan once the nodes appear.
+func TestFilterMissingDevNodes(t *testing.T) {
+	defer func() { devNodePresent = FileExist }()
+	present := map[string]bool{"/dev/dri/renderD128": true}
+	devNodePresent = func(fname string) bool { return present[fname] }
+
+	devices := func() map[string]Device {
+		return map[string]Device{
+			"SN-A": {sn: "SN-A", Nodes: []Node{{User: "/dev/dri/renderD128"}}},
+			"SN-B": {sn: "SN-B", Nodes: []Node{{User: "/dev/dri/renderD129"}}},
+		}
+	}
+	filtered := filterMissingDevNodes(devices())
+	if _, ok := filtered["SN-A"]; !ok {
+		t.Error("card with present nodes was dropped")
+	}
+	if _, ok := filtered["SN-B"]; ok {
+		t.Error("card with a missing render node was advertised")
+	}
+
+	// udev caught up: the card comes back on the next scan
+	present["/dev/dri/renderD129"] = true
+	if _, ok := filterMissingDevNodes(devices())["SN-B"]; !ok {
+		t.Error("card still withheld after its node appeared")
+	}
+}
+
+func BenchmarkEnumerateSubdevNodes(b *testing.B) {
+	dir, err := ioutil.TempDir("", "xfpga")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	makeSubdevDir(b, dir, 64)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		enumerateSubdevNodes(dir)
+	}
+}
+
+func TestGetInstance(t *testing.T) {
+	// the instance number is dom<<16 | bus<<8 | dev<<3 | fn, matching
+	// the xocl driver; wide (>16 bit) domains must parse too while
+	// narrow BDFs keep their historical values
+	valid := []struct {
+		bdf  string
+		want string
+	}{
+		{"0000:65:00.0", "25856"},
+		{"0000:65:00.1", "25857"},
+		{"0000:d8:00.1", "55297"},
+		{"10000:03:00.1", "4294968065"},
+		// a missing domain defaults to 0
+		{"af:00.1", "44801"},
+		{"0000:af:00.1", "44801"},
+	}
+	for _, c := range valid {
+		got, err := GetInstance(c.bdf)
+		if err != nil {
+			t.Errorf("GetInstance(%q): %v", c.bdf, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("GetInstance(%q) = %s, want %s", c.bdf, got, c.want)
+		}
+	}
+
+	cases := []struct {
+		bdf   string
+		field string
+	}{
+		{"", "format"},
+		{"abc", "format"},
+		{"0000:65", "format"},
+		{"0000:65:00", "format"},
+		{"zz:00.1", "bus"},
+		{"zzzz:65:00.1", "domain"},
+		{"0000:1ff:00.1", "bus"},
+		{"0000:65:1ff.1", "device"},
+		{"0000:65:00.1ff", "function"},
+	}
+	for _, c := range cases {
+		_, err := GetInstance(c.bdf)
+		if err == nil {
+			t.Errorf("GetInstance(%q) succeeded, want %s error", c.bdf, c.field)
+			continue
+		}
+		var parseErr *BDFParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("GetInstance(%q) returned %T, want *BDFParseError", c.bdf, err)
+			continue
+		}
+		if parseErr.Field != c.field {
+			t.Errorf("GetInstance(%q) failed on %s, want %s", c.bdf, parseErr.Field, c.field)
+		}
+	}
+}
+
+// plantUserPF builds a fake sysfs device directory for a user PF under
+// root, with the standard classic-layout fixture files.
+func plantUserPF(t *testing.T, root, bdf, serial, vbnv, ts, ready string) string {
+	t.Helper()
+	// the fixture has no /dev nodes backing the sysfs names; discovery
+	// must not drop its cards for that
+	devNodePresent = func(string) bool { return true }
+	t.Cleanup(func() { devNodePresent = FileExist })
+	devDir := path.Join(root, bdf)
+	for _, dir := range []string{
+		devDir,
+		path.Join(devDir, "xmc.u129"),
+		path.Join(devDir, "rom.u130"),
+		path.Join(devDir, "drm", "renderD128"),
+		path.Join(devDir, "dma.qdma.u25857"),
+	} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for fname, content := range map[string]string{
+		VendorFile:                           XilinxVendorID,
+		UserFile:                             "",
+		ReadyFile:                            ready,
+		DeviceFile:                           "0x5001",
+		path.Join("xmc.u129", SerialNumFile): serial,
+		path.Join("rom.u130", DSAverFile):    vbnv,
+		path.Join("rom.u130", DSAtsFile):     ts,
+	} {
+		if err := ioutil.WriteFile(path.Join(devDir, fname), []byte(content+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return devDir
+}
+
+func TestGetDevicesFakeSysfs(t *testing.T) {
+	defer func() { locator = pciLocator{root: SysfsDevices} }()
+
+	cases := []struct {
+		name       string
+		ready      string
+		wantHealth string
+		wantDiag   string
+	}{
+		{"ready U250 is discovered", FPGAReady, pluginapi.Healthy, ""},
+		// a present but initializing card (e.g. HBM ECC init) is
+		// advertised unhealthy, not dropped
+		{"unready board is advertised unhealthy", "0x0", pluginapi.Unhealthy, "shell not ready"},
+	}
+	for _, c := range cases {
+		root := t.TempDir()
+		plantUserPF(t, root, "0000:65:00.1", "SN-A", "xilinx_u250_xdma_201830_2", "1561465320", c.ready)
+		locator = pciLocator{root: root}
+
+		devices, diags, err := GetDevices()
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		device, found := devices["SN-A"]
+		if !found {
+			t.Errorf("%s: device not found (diags %v)", c.name, diags)
+			continue
+		}
+		if device.Healthy != c.wantHealth {
+			t.Errorf("%s: health = %s, want %s", c.name, device.Healthy, c.wantHealth)
+		}
+		if c.wantDiag != "" {
+			matched := false
+			for _, diag := range diags {
+				if diag.PciID == "0000:65:00.1" && diag.Step == c.wantDiag {
+					matched = true
+				}
+			}
+			if !matched {
+				t.Errorf("%s: no %q diagnostic, got %v", c.name, c.wantDiag, diags)
+			}
+		}
+		if device.shellVer != "xilinx_u250_xdma_201830_2" || device.timestamp != "1561465320" {
+			t.Errorf("%s: device = %+v", c.name, device)
+		}
+		if device.tsValue != 1561465320 {
+			t.Errorf("%s: tsValue = %d", c.name, device.tsValue)
+		}
+		if len(device.Nodes) != 1 {
+			t.Fatalf("%s: nodes = %+v", c.name, device.Nodes)
+		}
+		node := device.Nodes[0]
+		if node.DBDF != "0000:65:00.1" || node.deviceID != "0x5001" {
+			t.Errorf("%s: node = %+v", c.name, node)
+		}
+		if node.User != path.Join(UserPrefix, "renderD128") {
+			t.Errorf("%s: user node = %q", c.name, node.User)
+		}
+		if node.Qdma != path.Join(SubdevPrefix, QDMASTR+"25857") {
+			t.Errorf("%s: qdma node = %q", c.name, node.Qdma)
+		}
+	}
+}
+
+// During the boot window the first scan re-polls a card whose ready
+// attribute still reads 0x0, so a board that finishes initializing a
+// moment after the plugin starts is advertised healthy right away
+// instead of waiting out a full poll interval.
+func TestBootWindowReadyRetry(t *testing.T) {
+	defer func() { locator = pciLocator{root: SysfsDevices} }()
+	defer func(retries int, delay time.Duration) {
+		bootRetries, bootRetryDelay = retries, delay
+		atomic.StoreUint32(&firstScanDone, 1)
+	}(bootRetries, bootRetryDelay)
+	bootRetries = 10
+	bootRetryDelay = 20 * time.Millisecond
+
+	root := t.TempDir()
+	devDir := plantUserPF(t, root, "0000:65:00.1", "SN-A", "xilinx_u250_xdma_201830_2", "1561465320", "0x0")
+	locator = pciLocator{root: root}
+
+	armBootWindow()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ioutil.WriteFile(path.Join(devDir, ReadyFile), []byte(FPGAReady+"\n"), 0644)
+	}()
+	devices, _, err := GetDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, found := devices["SN-A"]
+	if !found {
+		t.Fatalf("device not found: %v", devices)
+	}
+	if device.Healthy != pluginapi.Healthy {
+		t.Errorf("card became ready within the boot window but is %s", device.Healthy)
+	}
+	if inBootWindow() {
+		t.Error("boot window should close with the first completed scan")
+	}
+
+	// steady state skips the retry: a not-ready card is reported
+	// unhealthy immediately rather than re-polled
+	if err := ioutil.WriteFile(path.Join(devDir, ReadyFile), []byte("0x0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	devices, _, err = GetDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > bootRetryDelay*time.Duration(bootRetries) {
+		t.Errorf("steady-state scan took %v, looks like it re-polled", elapsed)
+	}
+	if device := devices["SN-A"]; device.Healthy == pluginapi.Healthy {
+		t.Error("not-ready card reported healthy in steady state")
+	}
+}
+
+// TestGetDevicesAdvantech covers discovery of an Advantech (0x13fe)
+// board end to end. These cards share the xocl-style user_pf/ready
+// markers and drm render node with Xilinx boards, but name the board
+// metadata differently (board_serial/board_name flat attributes instead
+// of the xmc.u*/rom.u* subdevice folders), so they exercise the
+// vendor-aware layout probing.
+func TestGetDevicesAdvantech(t *testing.T) {
+	defer func() { locator = pciLocator{root: SysfsDevices} }()
+	devNodePresent = func(string) bool { return true }
+	t.Cleanup(func() { devNodePresent = FileExist })
+
+	root := t.TempDir()
+	devDir := path.Join(root, "0000:3b:00.1")
+	for _, dir := range []string{devDir, path.Join(devDir, "drm", "renderD64")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for fname, content := range map[string]string{
+		VendorFile:          ADVANTECH_ID,
+		UserFile:            "",
+		ReadyFile:           FPGAReady,
+		DeviceFile:          "0x0205",
+		AdvantechSerialFile: "AVT-0042",
+		AdvantechShellFile:  "advantech_vega4000_gen3x16",
+	} {
+		if err := ioutil.WriteFile(path.Join(devDir, fname), []byte(content+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	locator = pciLocator{root: root}
+
+	devices, diags, err := GetDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, found := devices["AVT-0042"]
+	if !found {
+		t.Fatalf("Advantech board not discovered (diags %v)", diags)
+	}
+	if device.shellVer != "advantech_vega4000_gen3x16" {
+		t.Errorf("shell = %q, want the board_name content", device.shellVer)
+	}
+	// no build_date attribute: the timestamp stays blank rather than
+	// failing discovery
+	if device.timestamp != "" {
+		t.Errorf("timestamp = %q, want blank", device.timestamp)
+	}
+	if len(device.Nodes) != 1 || device.Nodes[0].User != path.Join(UserPrefix, "renderD64") {
+		t.Errorf("nodes = %+v", device.Nodes)
+	}
+}
+
+func TestSerialFromBoardInfo(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"spelled out", "Max Power: 225\nSerial Num: SN-INFO-1\nMac Addr: 00:0a\n", "SN-INFO-1"},
+		{"underscore key", "serial_number:SN-INFO-2\n", "SN-INFO-2"},
+		{"abbreviated", "SN: SN-INFO-3\n", "SN-INFO-3"},
+		{"no serial field", "Max Power: 225\n", ""},
+		{"empty value", "Serial Num:\n", ""},
+	}
+	for _, c := range cases {
+		fname := path.Join(dir, strings.ReplaceAll(c.name, " ", "-"))
+		if err := ioutil.WriteFile(fname, []byte(c.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := serialFromBoardInfo(fname); got != c.want {
+			t.Errorf("%s: serial = %q, want %q", c.name, got, c.want)
+		}
+	}
+	if got := serialFromBoardInfo(path.Join(dir, "absent")); got != "" {
+		t.Errorf("missing board_info yielded %q", got)
+	}
+}
+
+// A shell without the standalone serial_num file but with the serial
+// folded into xmc.u*/board_info is still keyed by its serial number.
+func TestGetDevicesBoardInfoSerial(t *testing.T) {
+	defer func() { locator = pciLocator{root: SysfsDevices} }()
+	root := t.TempDir()
+	devDir := plantUserPF(t, root, "0000:65:00.1", "", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+	if err := os.Remove(path.Join(devDir, "xmc.u129", SerialNumFile)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(devDir, "xmc.u129", BoardInfoFile),
+		[]byte("Serial Num: SN-INFO\nMax Power: 225\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	locator = pciLocator{root: root}
+
+	devices, _, err := GetDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := devices["SN-INFO"]; !found {
+		t.Errorf("board_info serial not used, devices = %v", devices)
+	}
+}
+
+func TestGetDevicesByResourceName(t *testing.T) {
+	defer func() { scanFunc = GetDevicesCached }()
+	u250 := Device{shellVer: "xilinx_u250_xdma_201830_2", timestamp: "1561465320",
+		Nodes: []Node{{DBDF: "0000:65:00.1"}}}
+	scanFunc = func() (map[string]Device, []DeviceError, error) {
+		return map[string]Device{
+			"SN-B": {sn: "SN-B", shellVer: u250.shellVer, timestamp: u250.timestamp, Nodes: u250.Nodes},
+			"SN-A": {sn: "SN-A", shellVer: u250.shellVer, timestamp: u250.timestamp, Nodes: u250.Nodes},
+			"SN-C": {sn: "SN-C", shellVer: "xilinx_u50_gen3x16_xdma_201920_3",
+				timestamp: "1592438887", Nodes: []Node{{DBDF: "0000:81:00.1"}}},
+			// a board whose shell version could not be read
+			"0000:af:00.1": {sn: "0000:af:00.1", Nodes: []Node{{DBDF: "0000:af:00.1"}}},
+		}, nil, nil
+	}
+
+	buckets, err := GetDevicesByResourceName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 3 {
+		t.Fatalf("expected 3 buckets, got %v", buckets)
+	}
+	u250Name := resourceNameOf(Device{shellVer: u250.shellVer, timestamp: u250.timestamp, Nodes: u250.Nodes})
+	bucket, ok := buckets[u250Name]
+	if !ok || len(bucket) != 2 {
+		t.Fatalf("U250 bucket = %v", bucket)
+	}
+	// sorted by serial for a stable order across calls
+	if bucket[0].sn != "SN-A" || bucket[1].sn != "SN-B" {
+		t.Errorf("U250 bucket order = %s, %s", bucket[0].sn, bucket[1].sn)
+	}
+	// the blank-shell board lands in the default bucket instead of
+	// being dropped
+	unknown, ok := buckets[UnknownResourceBucket]
+	if !ok || len(unknown) != 1 || unknown[0].sn != "0000:af:00.1" {
+		t.Errorf("unknown bucket = %v", unknown)
+	}
+}
+
+func TestResolveDeviceIdentity(t *testing.T) {
+	defer func() { scanFunc = GetDevicesCached }()
+	scanFunc = func() (map[string]Device, []DeviceError, error) {
+		return map[string]Device{
+			"SN-A": {sn: "SN-A", shellVer: "xilinx_u250_xdma_201830_2",
+				Nodes: []Node{{DBDF: "0000:af:00.1",
+					User:        "/dev/dri/renderD128",
+					SubdevNodes: []string{"/dev/xfpga/xvc_pub.u25857"},
+					Qdma:        "/dev/xfpga/dma.qdma.u25857"}}},
+			"SN-B": {sn: "SN-B", shellVer: "xilinx_u50_gen3x16_xdma_201920_3",
+				Nodes: []Node{{DBDF: "0000:81:00.1",
+					User: "/dev/dri/renderD129"}}},
+		}, nil, nil
+	}
+
+	// a render node path, a raw BDF and a BDF in a different case all
+	// resolve to the owning board
+	for _, id := range []string{"/dev/dri/renderD128", "0000:af:00.1", "0000:AF:00.1",
+		"/dev/xfpga/xvc_pub.u25857", "/dev/xfpga/dma.qdma.u25857"} {
+		device, node, err := ResolveDeviceIdentity(id)
+		if err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		if device.sn != "SN-A" || node.DBDF != "0000:af:00.1" {
+			t.Errorf("%s resolved to device %s node %s", id, device.sn, node.DBDF)
+		}
+	}
+	if device, _, err := ResolveDeviceIdentity("0000:81:00.1"); err != nil || device.sn != "SN-B" {
+		t.Errorf("0000:81:00.1 resolved to %s, %v", device.sn, err)
+	}
+
+	// an id no discovered card owns is an error, not a zero Device
+	if _, _, err := ResolveDeviceIdentity("/dev/dri/renderD200"); err == nil {
+		t.Error("unknown node path resolved without error")
+	}
+	if _, _, err := ResolveDeviceIdentity("0000:d8:00.1"); err == nil {
+		t.Error("unknown BDF resolved without error")
+	}
+}
+
+func TestGetFileNamesFromPrefix(t *testing.T) {
+	dir := t.TempDir()
+	// created out of order; lookups must come back sorted
+	for _, name := range []string{"renderD129", "renderD128", "card0"} {
+		if err := ioutil.WriteFile(path.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names, err := GetFileNamesFromPrefix(dir, DRMSTR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "renderD128" || names[1] != "renderD129" {
+		t.Errorf("names = %v, want [renderD128 renderD129]", names)
+	}
+
+	first, err := GetFileNameFromPrefix(dir, DRMSTR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != "renderD128" {
+		t.Errorf("first = %q, want renderD128", first)
+	}
+
+	if none, err := GetFileNameFromPrefix(dir, "xmc.u"); err != nil || none != "" {
+		t.Errorf("no match: got %q, %v", none, err)
+	}
+	if _, err := GetFileNamesFromPrefix(path.Join(dir, "absent"), DRMSTR); err == nil {
+		t.Error("missing dir did not error")
+	}
+}
+
+func TestMarkExpectedShellMismatches(t *testing.T) {
+	defer func() { expectedShells = make(map[string]string) }()
+	expectedShells = map[string]string{"0x5001": "xilinx_u250_xdma_201830_2"}
+
+	devices := map[string]Device{
+		"SN-OK": {
+			sn:       "SN-OK",
+			shellVer: "xilinx_u250_xdma_201830_2",
+			Healthy:  pluginapi.Healthy,
+			Nodes:    []Node{{deviceID: "0x5001"}},
+		},
+		"SN-WRONG": {
+			sn:       "SN-WRONG",
+			shellVer: "xilinx_u250_qep_201910_1",
+			Healthy:  pluginapi.Healthy,
+			Nodes:    []Node{{deviceID: "0x5001"}},
+		},
+		"SN-OTHER": {
+			sn:       "SN-OTHER",
+			shellVer: "xilinx_u200_xdma_201830_1",
+			Healthy:  pluginapi.Healthy,
+			Nodes:    []Node{{deviceID: "0x5000"}},
+		},
+	}
+	markExpectedShellMismatches(devices)
+
+	if devices["SN-OK"].Healthy != pluginapi.Healthy || devices["SN-OK"].shellMismatch {
+		t.Errorf("matching board flagged: %+v", devices["SN-OK"])
+	}
+	if devices["SN-WRONG"].Healthy != pluginapi.Unhealthy || !devices["SN-WRONG"].shellMismatch {
+		t.Errorf("mismatching board not withheld: %+v", devices["SN-WRONG"])
+	}
+	if devices["SN-OTHER"].Healthy != pluginapi.Healthy {
+		t.Errorf("board of an unconfigured device id touched: %+v", devices["SN-OTHER"])
+	}
+
+	// no expectations configured: untouched
+	expectedShells = make(map[string]string)
+	devices["SN-WRONG"] = Device{sn: "SN-WRONG", shellVer: "x", Healthy: pluginapi.Healthy,
+		Nodes: []Node{{deviceID: "0x5001"}}}
+	markExpectedShellMismatches(devices)
+	if devices["SN-WRONG"].Healthy != pluginapi.Healthy {
+		t.Error("board flagged without configured expectations")
+	}
+}
+
+func TestParseVendorIDs(t *testing.T) {
+	ids, err := parseVendorIDs("0x1BB1, 13fe,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] != "0x1bb1" || ids[1] != "0x13fe" {
+		t.Errorf("ids = %v", ids)
+	}
+
+	for _, bad := range []string{"xyz", "0x12345", "0x10ee;0x1bb1"} {
+		if _, err := parseVendorIDs(bad); err == nil {
+			t.Errorf("%q accepted, want error", bad)
+		}
+	}
+
+	if ids, err := parseVendorIDs(""); err != nil || len(ids) != 0 {
+		t.Errorf("empty list: got %v, %v", ids, err)
+	}
+}
+
+func TestIsKnownVendor(t *testing.T) {
+	defer func() { extraVendorIDs = nil }()
+
+	for _, id := range []string{XilinxVendorID, AWS_ID, ADVANTECH_ID, "0x10EE"} {
+		if !isKnownVendor(id) {
+			t.Errorf("built-in vendor %s not recognized", id)
+		}
+	}
+	if isKnownVendor("0x1bb1") {
+		t.Error("OEM vendor recognized without configuration")
+	}
+	extraVendorIDs = []string{"0x1bb1"}
+	if !isKnownVendor("0x1bb1") || !isKnownVendor("0x1BB1") {
+		t.Error("configured OEM vendor not recognized")
+	}
+}
+
+func TestGetDevicesClockFreqs(t *testing.T) {
+	defer func() { locator = pciLocator{root: SysfsDevices} }()
+
+	// with the icap attribute the frequencies are picked up
+	root := t.TempDir()
+	devDir := plantUserPF(t, root, "0000:65:00.1", "SN-A", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+	icapDir := path.Join(devDir, "icap.u25857")
+	if err := os.MkdirAll(icapDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(icapDir, ClockFreqsFile), []byte("300\n500\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	locator = pciLocator{root: root}
+	devices, _, err := GetDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := devices["SN-A"].clockFreqs; got != "300,500" {
+		t.Errorf("clockFreqs = %q, want 300,500", got)
+	}
+	if view := viewOf(devices["SN-A"]); view.ClockFreqs != "300,500" {
+		t.Errorf("view.ClockFreqs = %q", view.ClockFreqs)
+	}
+	if got := deviceAttribute(devices["SN-A"], "clock_freqs"); got != "300,500" {
+		t.Errorf("attribute clock_freqs = %q", got)
+	}
+
+	// without it the field stays empty and discovery still succeeds
+	root = t.TempDir()
+	plantUserPF(t, root, "0000:65:00.1", "SN-B", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+	locator = pciLocator{root: root}
+	devices, _, err = GetDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := devices["SN-B"].clockFreqs; got != "" {
+		t.Errorf("clockFreqs = %q, want empty", got)
+	}
+}
+
+func TestGetDevicesSysfsAbsentVsEmpty(t *testing.T) {
+	defer func() { locator = pciLocator{root: SysfsDevices} }()
+
+	// missing PCI tree: a loud misconfiguration error
+	locator = pciLocator{root: path.Join(t.TempDir(), "absent")}
+	if _, _, err := GetDevices(); err == nil ||
+		!strings.Contains(err.Error(), "No PCI sysfs") {
+		t.Errorf("missing sysfs returned %v, want a mount hint", err)
+	}
+
+	// present but without any FPGA: a normal empty result
+	locator = pciLocator{root: t.TempDir()}
+	devices, diags, err := GetDevices()
+	if err != nil {
+		t.Fatalf("empty sysfs errored: %v", err)
+	}
+	if len(devices) != 0 || len(diags) != 0 {
+		t.Errorf("empty sysfs returned %v, %v", devices, diags)
+	}
+
+	// the cached entry point, which the plugin's scan loop actually
+	// uses, carries the same mount hint
+	locator = pciLocator{root: path.Join(t.TempDir(), "absent")}
+	if _, _, err := GetDevicesCached(); err == nil ||
+		!strings.Contains(err.Error(), "No PCI sysfs") {
+		t.Errorf("missing sysfs returned %v from the cached scan, want a mount hint", err)
+	}
+}
+
+func TestGetDevicesQdmaInstance(t *testing.T) {
+	defer func() { locator = pciLocator{root: SysfsDevices} }()
+
+	cases := []struct {
+		name string
+		// the qdma folder planted in sysfs; plantUserPF creates the
+		// user PF at func 1 (0000:65:00.1, instance 25857)
+		qdmaFolder string
+		wantQdma   string
+	}{
+		{"suffix matches the user PF func 1", "dma.qdma.u25857", QDMASTR + "25857"},
+		{"shell keys qdma off the mgmt PF func 0", "dma.qdma.u25856", QDMASTR + "25856"},
+	}
+	for _, c := range cases {
+		root := t.TempDir()
+		devDir := plantUserPF(t, root, "0000:65:00.1", "SN-A", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+		if c.qdmaFolder != "dma.qdma.u25857" {
+			if err := os.Rename(path.Join(devDir, "dma.qdma.u25857"),
+				path.Join(devDir, c.qdmaFolder)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		locator = pciLocator{root: root}
+
+		devices, _, err := GetDevices()
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		device, ok := devices["SN-A"]
+		if !ok {
+			t.Fatalf("%s: device not found", c.name)
+		}
+		if got, want := device.Nodes[0].Qdma, path.Join(SubdevPrefix, c.wantQdma); got != want {
+			t.Errorf("%s: Qdma = %q, want %q", c.name, got, want)
+		}
+	}
+}
+
+func TestSelectRenderNode(t *testing.T) {
+	capture := &captureLogger{}
+	SetLogger(capture)
+	defer SetLogger(nil)
+
+	dir := t.TempDir()
+	// renderD9 sorts after renderD128 lexically but wins numerically
+	for _, name := range []string{"renderD128", "renderD9", "card0"} {
+		if err := ioutil.WriteFile(path.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	node, err := selectRenderNode(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node != "renderD9" {
+		t.Errorf("node = %q, want renderD9", node)
+	}
+	if len(capture.warns) != 1 || !strings.Contains(capture.warns[0], "render nodes") {
+		t.Errorf("ambiguity not warned: %v", capture.warns)
+	}
+
+	// a single node comes back silently
+	capture.warns = nil
+	single := t.TempDir()
+	if err := ioutil.WriteFile(path.Join(single, "renderD128"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if node, err := selectRenderNode(single); err != nil || node != "renderD128" {
+		t.Errorf("single node: got %q, %v", node, err)
+	}
+	if len(capture.warns) != 0 {
+		t.Errorf("unexpected warnings %v", capture.warns)
+	}
+
+	// a drm dir with only a card* entry yields a clear error instead of
+	// an empty node name
+	cardOnly := t.TempDir()
+	if err := ioutil.WriteFile(path.Join(cardOnly, "card0"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if node, err := selectRenderNode(cardOnly); err == nil {
+		t.Errorf("card-only dir returned %q without error", node)
+	} else if !strings.Contains(err.Error(), DRMSTR) {
+		t.Errorf("error %v does not name the missing node type", err)
+	}
+}
+
+func TestResolveQdmaNodes(t *testing.T) {
+	capture := &captureLogger{}
+	SetLogger(capture)
+	defer SetLogger(nil)
+
+	// existing paths pass through untouched
+	got := resolveQdmaNodes(
+		[]string{"/dev/xfpga/dma.qdma.u25857"},
+		[]string{"/dev/xfpga/dma.qdma.u25857"})
+	if len(got) != 1 || got[0] != "/dev/xfpga/dma.qdma.u25857" {
+		t.Errorf("matching node rewritten: %v", got)
+	}
+	if len(capture.warns) != 0 {
+		t.Errorf("unexpected warnings %v", capture.warns)
+	}
+
+	// a single real node wins over a wrong computed path
+	got = resolveQdmaNodes(
+		[]string{"/dev/xfpga/dma.qdma.u25857"},
+		[]string{"/dev/xfpga/dma.qdma.u25858"})
+	if len(got) != 1 || got[0] != "/dev/xfpga/dma.qdma.u25858" {
+		t.Errorf("single present node not preferred: %v", got)
+	}
+	if len(capture.warns) != 1 || !strings.Contains(capture.warns[0], "does not exist") {
+		t.Errorf("mismatch not warned: %v", capture.warns)
+	}
+
+	// ambiguous: several real nodes, keep the computed path
+	capture.warns = nil
+	got = resolveQdmaNodes(
+		[]string{"/dev/xfpga/dma.qdma.u1"},
+		[]string{"/dev/xfpga/dma.qdma.u2", "/dev/xfpga/dma.qdma.u3"})
+	if len(got) != 1 || got[0] != "/dev/xfpga/dma.qdma.u1" {
+		t.Errorf("ambiguous case rewrote the computed path: %v", got)
+	}
+	if len(capture.warns) != 1 {
+		t.Errorf("ambiguous case not warned: %v", capture.warns)
+	}
+
+	// nothing visible under /dev/xfpga: pass through silently
+	capture.warns = nil
+	got = resolveQdmaNodes([]string{"/dev/xfpga/dma.qdma.u1"}, nil)
+	if len(got) != 1 || got[0] != "/dev/xfpga/dma.qdma.u1" || len(capture.warns) != 0 {
+		t.Errorf("empty present list changed behavior: %v %v", got, capture.warns)
+	}
+}
+
+func TestGetDevicesMultiQdma(t *testing.T) {
+	defer func() { locator = pciLocator{root: SysfsDevices} }()
+
+	root := t.TempDir()
+	devDir := plantUserPF(t, root, "0000:65:00.1", "SN-A", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+	if err := os.MkdirAll(path.Join(devDir, "dma.qdma.u25858"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	locator = pciLocator{root: root}
+
+	devices, _, err := GetDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, ok := devices["SN-A"]
+	if !ok {
+		t.Fatal("device not found")
+	}
+	node := device.Nodes[0]
+	want := []string{
+		path.Join(SubdevPrefix, QDMASTR+"25857"),
+		path.Join(SubdevPrefix, QDMASTR+"25858"),
+	}
+	if len(node.Qdmas) != 2 || node.Qdmas[0] != want[0] || node.Qdmas[1] != want[1] {
+		t.Errorf("Qdmas = %v, want %v", node.Qdmas, want)
+	}
+	if node.Qdma != want[0] {
+		t.Errorf("Qdma = %q, want first instance %q", node.Qdma, want[0])
+	}
+	specs := device.DeviceSpecs()
+	qdmaSpecs := 0
+	for _, spec := range specs {
+		if strings.HasPrefix(spec.HostPath, path.Join(SubdevPrefix, QDMASTR)) {
+			qdmaSpecs++
+		}
+	}
+	if qdmaSpecs != 2 {
+		t.Errorf("Allocate mounts %d qdma node(s), want 2 (%v)", qdmaSpecs, specs)
+	}
+}
+
+func TestParseVBNV(t *testing.T) {
+	valid := []struct {
+		raw  string
+		want VBNV
+	}{
+		{"xilinx_u250_xdma_201830_2",
+			VBNV{"xilinx", "u250", "xdma", "201830_2"}},
+		{"xilinx_u250_gen3x16_xdma_3_1_202020_1",
+			VBNV{"xilinx", "u250", "gen3x16_xdma", "3_1_202020_1"}},
+		{"xilinx_u50_gen3x16_xdma_201920_3",
+			VBNV{"xilinx", "u50", "gen3x16_xdma", "201920_3"}},
+	}
+	for _, c := range valid {
+		got, err := ParseVBNV(c.raw)
+		if err != nil {
+			t.Errorf("ParseVBNV(%q): %v", c.raw, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("ParseVBNV(%q) = %+v, want %+v", c.raw, got, c.want)
+		}
+	}
+
+	for _, raw := range []string{
+		"",
+		"xilinx",
+		"xilinx_u250",
+		"xilinx_u250_xdma",  // no version suffix
+		"xilinx_u250_xdma_", // empty version component
+		"__xdma_201830_2",
+	} {
+		if _, err := ParseVBNV(raw); err == nil {
+			t.Errorf("ParseVBNV(%q) succeeded, want error", raw)
+		}
+	}
+}
+
+func TestGetDevicesOptionalMetadata(t *testing.T) {
+	defer func() { locator = pciLocator{root: SysfsDevices} }()
+
+	root := t.TempDir()
+	devDir := plantUserPF(t, root, "0000:65:00.1", "SN-A", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+	// the VBNV attribute vanished (e.g. mid driver reload); the board
+	// must still be advertised, with a blank shell version
+	if err := os.Remove(path.Join(devDir, "rom.u130", DSAverFile)); err != nil {
+		t.Fatal(err)
+	}
+	locator = pciLocator{root: root}
+
+	devices, diags, err := GetDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, ok := devices["SN-A"]
+	if !ok {
+		t.Fatalf("board with unreadable VBNV dropped: %v (diags %v)", devices, diags)
+	}
+	if device.shellVer != "" {
+		t.Errorf("shell version = %q, want blank", device.shellVer)
+	}
+	if device.timestamp != "1561465320" {
+		t.Errorf("readable metadata lost: %+v", device)
+	}
+}
+
+func TestGetDevicesContextCancel(t *testing.T) {
+	defer func() { locator = pciLocator{root: SysfsDevices} }()
+
+	root := t.TempDir()
+	plantUserPF(t, root, "0000:65:00.1", "SN-A", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+	locator = pciLocator{root: root}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := GetDevicesContext(ctx); err != context.Canceled {
+		t.Errorf("cancelled discovery returned %v, want context.Canceled", err)
+	}
+
+	// an un-cancelled context behaves exactly like GetDevices
+	devices, _, err := GetDevicesContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := devices["SN-A"]; !ok {
+		t.Errorf("card not discovered: %v", devices)
+	}
+}
+
+func TestGetDevicesMgmtOnlyCount(t *testing.T) {
+	defer func() {
+		locator = pciLocator{root: SysfsDevices}
+		SetLogger(logrusLogger{})
+	}()
+
+	root := t.TempDir()
+	// a board showing only its mgmt PF: the user PF went to a VM
+	mgmtDir := path.Join(root, "0000:65:00.0")
+	if err := os.MkdirAll(path.Join(mgmtDir, "xmc.u129"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for fname, content := range map[string]string{
+		VendorFile:                           XilinxVendorID,
+		MgmtFile:                             "",
+		path.Join("xmc.u129", SerialNumFile): "SN-ELSEWHERE",
+	} {
+		if err := ioutil.WriteFile(path.Join(mgmtDir, fname), []byte(content+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	locator = pciLocator{root: root}
+	captured := &captureLogger{}
+	SetLogger(captured)
+
+	devices, _, err := GetDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 0 {
+		t.Errorf("mgmt PF advertised as a device: %v", devices)
+	}
+	found := false
+	for _, msg := range captured.infos {
+		if strings.Contains(msg, "only their mgmt PF") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("mgmt-only board not surfaced, got %v", captured.infos)
+	}
+}
+
+func TestGetDevicesVirtualFunctions(t *testing.T) {
+	defer func() { locator = pciLocator{root: SysfsDevices} }()
+
+	root := t.TempDir()
+	devDir := plantUserPF(t, root, "0000:65:00.1", "SN-A", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+	// an SR-IOV VF: its own sysfs dir with a render node, reached from
+	// the PF through the virtfn0 symlink
+	vfDir := path.Join(root, "0000:65:00.5")
+	if err := os.MkdirAll(path.Join(vfDir, "drm", "renderD130"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../0000:65:00.5", path.Join(devDir, "virtfn0")); err != nil {
+		t.Fatal(err)
+	}
+	locator = pciLocator{root: root}
+
+	devices, _, err := GetDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, ok := devices["SN-A"]
+	if !ok {
+		t.Fatalf("PF not discovered: %v", devices)
+	}
+	if len(device.Nodes) != 2 {
+		t.Fatalf("expected PF plus one VF node, got %+v", device.Nodes)
+	}
+	vf := device.Nodes[1]
+	if vf.DBDF != "0000:65:00.5" {
+		t.Errorf("VF node = %+v", vf)
+	}
+	if vf.User != path.Join(UserPrefix, "renderD130") {
+		t.Errorf("VF user node = %q", vf.User)
+	}
+}
+
+func TestGetDevicesSerialCollisions(t *testing.T) {
+	defer func() { locator = pciLocator{root: SysfsDevices} }()
+
+	root := t.TempDir()
+	// two distinct cards reporting the same serial, plus one reporting
+	// none at all
+	plantUserPF(t, root, "0000:65:00.1", "SN-DUP", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+	plantUserPF(t, root, "0000:d8:00.1", "SN-DUP", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+	plantUserPF(t, root, "0000:af:00.1", "", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+	locator = pciLocator{root: root}
+
+	devices, diags, err := GetDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 3 {
+		t.Fatalf("colliding serials merged cards: %v", devices)
+	}
+	// the collision is surfaced as a diagnostic naming the later card
+	matched := false
+	for _, diag := range diags {
+		if diag.PciID == "0000:d8:00.1" && diag.Step == "duplicate serial" {
+			matched = true
+		}
+	}
+	if !matched {
+		t.Errorf("no duplicate-serial diagnostic, got %v", diags)
+	}
+	// the first card keeps its serial; the colliding and empty-serial
+	// cards fall back to their BDFs
+	for _, key := range []string{"SN-DUP", "0000:d8:00.1", "0000:af:00.1"} {
+		device, ok := devices[key]
+		if !ok {
+			t.Errorf("no device keyed %q: %v", key, devices)
+			continue
+		}
+		if len(device.Nodes) != 1 || device.sn != key {
+			t.Errorf("device %q = %+v", key, device)
+		}
+	}
+}
+
+func TestGetDevicesBDFKeying(t *testing.T) {
+	defer func() {
+		locator = pciLocator{root: SysfsDevices}
+		deviceKeying = deviceKeySerial
+	}()
+
+	root := t.TempDir()
+	plantUserPF(t, root, "0000:65:00.1", "SN-A", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+	plantUserPF(t, root, "0000:d8:00.1", "SN-B", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+	locator = pciLocator{root: root}
+	deviceKeying = deviceKeyBDF
+
+	devices, _, err := GetDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bdf := range []string{"0000:65:00.1", "0000:d8:00.1"} {
+		device, ok := devices[bdf]
+		if !ok {
+			t.Errorf("no device keyed by BDF %s: %v", bdf, devices)
+			continue
+		}
+		if len(device.Nodes) != 1 || device.Nodes[0].DBDF != bdf {
+			t.Errorf("device %s = %+v", bdf, device)
+		}
+	}
+}
+
+func TestFilterShell(t *testing.T) {
+	cases := []struct {
+		filter string
+		want   []string
+	}{
+		{"", []string{"SN-A", "SN-B"}},
+		{"xilinx_u250_xdma_201830_2", []string{"SN-A"}},
+		{"xilinx_u250_*", []string{"SN-A"}},
+		{"xilinx_*", []string{"SN-A", "SN-B"}},
+		{"xilinx_u280_*", []string{"SN-B"}},
+		{"nomatch", nil},
+	}
+	for _, c := range cases {
+		devices := map[string]Device{
+			"SN-A": {sn: "SN-A", shellVer: "xilinx_u250_xdma_201830_2"},
+			"SN-B": {sn: "SN-B", shellVer: "xilinx_u280_xdma_201920_3"},
+		}
+		filtered := filterShell(devices, c.filter)
+		if len(filtered) != len(c.want) {
+			t.Errorf("filter %q kept %v, want %v", c.filter, filtered, c.want)
+			continue
+		}
+		for _, sn := range c.want {
+			if _, ok := filtered[sn]; !ok {
+				t.Errorf("filter %q dropped %s", c.filter, sn)
+			}
+		}
+	}
+}
+
+func TestDeviceSpecs(t *testing.T) {
+	device := Device{
+		sn: "serialA",
+		Nodes: []Node{{
+			User:        "/dev/dri/renderD128",
+			SubdevNodes: []string{"/dev/xfpga/xvc_pub.u25857"},
+			Qdma:        "/dev/xfpga/dma.qdma.u25857",
+		}, {
+			User: "/dev/dri/renderD129",
+			// no qdma on this node; it must be omitted, not emitted
+			// as an empty path
+		}},
+	}
+	specs := device.DeviceSpecs()
+	var paths []string
+	for _, spec := range specs {
+		if spec.HostPath == "" || spec.HostPath != spec.ContainerPath {
+			t.Errorf("bad spec %+v", spec)
+		}
+		paths = append(paths, spec.HostPath)
+	}
+	want := []string{
+		"/dev/dri/renderD128",
+		"/dev/xfpga/xvc_pub.u25857",
+		"/dev/xfpga/dma.qdma.u25857",
+		"/dev/dri/renderD129",
+	}
+	if len(paths) != len(want) {
+		t.Fatalf("specs = %v, want %v", paths, want)
+	}
+	for i := range want {
+		if paths[i] != want[i] {
+			t.Errorf("spec %d = %s, want %s", i, paths[i], want[i])
+		}
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    uint64
+		wantErr bool
+	}{
+		{"1561465320", 1561465320, false},
+		{"0x5D11C2E8", 0x5D11C2E8, false},
+		{"0X5d11c2e8", 0x5D11C2E8, false},
+		// bare hex, as some releases emit it
+		{"5d11c2e8", 0x5D11C2E8, false},
+		{" 1561465320\n", 1561465320, false},
+		{"", 0, true},
+		{"not-a-timestamp", 0, true},
+	}
+	for _, c := range cases {
+		got, err := ParseTimestamp(c.in)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("ParseTimestamp(%q) = %d, expected error", c.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseTimestamp(%q): %v", c.in, err)
+		} else if got != c.want {
+			t.Errorf("ParseTimestamp(%q) = %d, want %d", c.in, got, c.want)
+		}
+	}
+}
+
+func TestTimestampNewerThan(t *testing.T) {
+	device := Device{timestamp: "1561465320", tsValue: 1561465320}
+	if !device.TimestampNewerThan(1500000000) {
+		t.Error("expected the device to be newer than 1500000000")
+	}
+	if device.TimestampNewerThan(1561465320) {
+		t.Error("equal timestamps are not newer")
+	}
+	if device.TimestampNewerThan(1600000000) {
+		t.Error("expected the device to be older than 1600000000")
+	}
+	// an unparseable timestamp is never newer than anything
+	garbage := Device{timestamp: "garbage", tsValue: 0}
+	if garbage.TimestampNewerThan(0) {
+		t.Error("a device without a parsed timestamp must not compare as newer")
+	}
+}
+
+func TestGetDevicesSkipsPCIBridges(t *testing.T) {
+	defer func() { locator = pciLocator{root: SysfsDevices} }()
+	root := t.TempDir()
+	plantUserPF(t, root, "0000:65:00.1", "SN-A", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+
+	// the upstream switch carries the board vendor's ID on some
+	// platforms; its class code marks it as a bridge, not an endpoint
+	bridgeDir := path.Join(root, "0000:64:00.0")
+	if err := os.MkdirAll(bridgeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for fname, content := range map[string]string{
+		VendorFile: XilinxVendorID,
+		ClassFile:  "0x060400",
+	} {
+		if err := ioutil.WriteFile(path.Join(bridgeDir, fname), []byte(content+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the endpoint itself carries a non-bridge class and must survive
+	// the filter
+	if err := ioutil.WriteFile(path.Join(root, "0000:65:00.1", ClassFile), []byte("0x120000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	locator = pciLocator{root: root}
+
+	devices, diags, err := GetDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := devices["SN-A"]; !ok {
+		t.Fatalf("endpoint not discovered (diags %v)", diags)
+	}
+	if len(devices) != 1 {
+		t.Errorf("bridge leaked into the device map: %v", devices)
+	}
+	for _, diag := range diags {
+		if diag.PciID == "0000:64:00.0" {
+			t.Errorf("bridge produced a diagnostic: %v", diag)
+		}
+	}
+}
+
+func TestIsPCIBridge(t *testing.T) {
+	dir := t.TempDir()
+	// no class attribute at all: not a bridge
+	if isPCIBridge(dir) {
+		t.Error("missing class file misreported as bridge")
+	}
+	cases := []struct {
+		class string
+		want  bool
+	}{
+		{"0x060400", true}, // PCI-to-PCI bridge
+		{"0x060000", true}, // host bridge
+		{"0X068000", true}, // other bridge, upper-case prefix
+		{"0x120000", false},
+		{"0x058000", false},
+	}
+	for _, c := range cases {
+		if err := ioutil.WriteFile(path.Join(dir, ClassFile), []byte(c.class+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := isPCIBridge(dir); got != c.want {
+			t.Errorf("isPCIBridge(class %s) = %v, want %v", c.class, got, c.want)
+		}
+	}
+}
+
+// TestGetDevicesConcurrencyDeterministic plants several boards,
+// including a duplicated serial, and checks that the parallel walk
+// produces exactly the serial walk's result: probes run concurrently,
+// but the merge settles slot numbers and collision keying in sorted
+// BDF order.
+func TestGetDevicesConcurrencyDeterministic(t *testing.T) {
+	defer func() {
+		locator = pciLocator{root: SysfsDevices}
+		discoveryConcurrency = 4
+	}()
+	root := t.TempDir()
+	plantUserPF(t, root, "0000:65:00.1", "SN-A", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+	plantUserPF(t, root, "0000:81:00.1", "SN-B", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+	// a clone: the later BDF must lose the serial and be keyed by BDF
+	plantUserPF(t, root, "0000:d8:00.1", "SN-A", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+	locator = pciLocator{root: root}
+
+	discoveryConcurrency = 1
+	serial, _, err := GetDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serial) != 3 {
+		t.Fatalf("serial walk found %d device(s): %v", len(serial), serial)
+	}
+
+	for _, workers := range []int{2, 8} {
+		discoveryConcurrency = workers
+		parallel, _, err := GetDevices()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parallel) != len(serial) {
+			t.Fatalf("concurrency %d found %d device(s), serial walk %d",
+				workers, len(parallel), len(serial))
+		}
+		for key, want := range serial {
+			got, ok := parallel[key]
+			if !ok {
+				t.Errorf("concurrency %d: key %s missing", workers, key)
+				continue
+			}
+			if got.sn != want.sn || got.shellVer != want.shellVer ||
+				len(got.Nodes) != len(want.Nodes) {
+				t.Errorf("concurrency %d: device %s = %+v, want %+v", workers, key, got, want)
+			}
+		}
+	}
+	// the clone lost the keying race regardless of worker count
+	if _, ok := serial["0000:d8:00.1"]; !ok {
+		t.Errorf("duplicate serial not keyed by BDF: %v", serial)
+	}
+}
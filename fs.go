@@ -0,0 +1,40 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// sysFS is the narrow filesystem surface discovery reads through, so
+// tests can substitute an in-memory sysfs tree instead of needing real
+// hardware under /sys.
+type sysFS interface {
+	ReadDir(dir string) ([]os.FileInfo, error)
+	ReadFile(file string) ([]byte, error)
+	Stat(name string) (os.FileInfo, error)
+}
+
+// osFS is the default sysFS, backed by the real filesystem.
+type osFS struct{}
+
+func (osFS) ReadDir(dir string) ([]os.FileInfo, error) { return ioutil.ReadDir(dir) }
+func (osFS) ReadFile(file string) ([]byte, error)      { return ioutil.ReadFile(file) }
+func (osFS) Stat(name string) (os.FileInfo, error)     { return os.Stat(name) }
+
+// fsys is what discovery reads through; tests swap it for a memFS.
+var fsys sysFS = osFS{}
@@ -0,0 +1,184 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+// memFS is an in-memory sysFS built from a flat path->content map;
+// directories are implied by the path prefixes of the files they hold.
+type memFS struct {
+	files map[string]string
+}
+
+func (m memFS) ReadFile(file string) ([]byte, error) {
+	content, ok := m.files[file]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: file, Err: os.ErrNotExist}
+	}
+	return []byte(content), nil
+}
+
+func (m memFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	seen := map[string]bool{}
+	var infos []os.FileInfo
+	for file := range m.files {
+		if !strings.HasPrefix(file, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(file, prefix)
+		name := rest
+		isDir := false
+		if i := strings.Index(rest, "/"); i >= 0 {
+			name = rest[:i]
+			isDir = true
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		infos = append(infos, memFileInfo{name: name, dir: isDir})
+	}
+	if len(infos) == 0 {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (m memFS) Stat(name string) (os.FileInfo, error) {
+	if _, ok := m.files[name]; ok {
+		return memFileInfo{name: path.Base(name)}, nil
+	}
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for file := range m.files {
+		if strings.HasPrefix(file, prefix) {
+			return memFileInfo{name: path.Base(name), dir: true}, nil
+		}
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+type memFileInfo struct {
+	name string
+	dir  bool
+}
+
+func (fi memFileInfo) Name() string { return fi.name }
+func (fi memFileInfo) Size() int64  { return 0 }
+func (fi memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return fi.dir }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+// memU250 returns a fake sysfs tree holding a single U250 user PF.
+func memU250(root, bdf string, extra map[string]string) map[string]string {
+	devDir := path.Join(root, bdf)
+	files := map[string]string{
+		path.Join(devDir, VendorFile):                       XilinxVendorID + "\n",
+		path.Join(devDir, UserFile):                         "\n",
+		path.Join(devDir, ReadyFile):                        FPGAReady + "\n",
+		path.Join(devDir, DeviceFile):                       "0x5001\n",
+		path.Join(devDir, "xmc.u129", SerialNumFile):        "SN-MEM\n",
+		path.Join(devDir, "rom.u130", DSAverFile):           "xilinx_u250_xdma_201830_2\n",
+		path.Join(devDir, "rom.u130", DSAtsFile):            "1561465320\n",
+		path.Join(devDir, "drm", "renderD128", "dev"):       "226:128\n",
+		path.Join(devDir, "dma.qdma.u25857", "placeholder"): "\n",
+	}
+	for file, content := range extra {
+		files[path.Join(devDir, file)] = content
+	}
+	return files
+}
+
+func TestGetDevicesMemFS(t *testing.T) {
+	const root = "/sys/bus/pci/devices"
+	const bdf = "0000:65:00.1"
+	defer func() {
+		fsys = osFS{}
+		locator = pciLocator{root: SysfsDevices}
+	}()
+	// the fake tree carries no /dev nodes
+	devNodePresent = func(string) bool { return true }
+	t.Cleanup(func() { devNodePresent = FileExist })
+
+	cases := []struct {
+		name     string
+		files    map[string]string
+		wantQdma string
+	}{
+		{
+			"full U250 with qdma",
+			memU250(root, bdf, nil),
+			path.Join(SubdevPrefix, QDMASTR+"25857"),
+		},
+		{
+			"U250 without qdma subdevice",
+			func() map[string]string {
+				files := memU250(root, bdf, nil)
+				delete(files, path.Join(root, bdf, "dma.qdma.u25857", "placeholder"))
+				return files
+			}(),
+			"",
+		},
+	}
+	for _, c := range cases {
+		fsys = memFS{files: c.files}
+		locator = pciLocator{root: root}
+
+		devices, diags, err := GetDevices()
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		device, found := devices["SN-MEM"]
+		if !found {
+			t.Fatalf("%s: device not found, diags %v", c.name, diags)
+		}
+		if device.shellVer != "xilinx_u250_xdma_201830_2" || device.timestamp != "1561465320" {
+			t.Errorf("%s: device = %+v", c.name, device)
+		}
+		if device.Healthy != pluginapi.Healthy {
+			t.Errorf("%s: health = %s", c.name, device.Healthy)
+		}
+		if len(device.Nodes) != 1 {
+			t.Fatalf("%s: nodes = %+v", c.name, device.Nodes)
+		}
+		node := device.Nodes[0]
+		if node.DBDF != bdf || node.deviceID != "0x5001" {
+			t.Errorf("%s: node = %+v", c.name, node)
+		}
+		if node.User != path.Join(UserPrefix, "renderD128") {
+			t.Errorf("%s: user node = %q", c.name, node.User)
+		}
+		if node.Qdma != c.wantQdma {
+			t.Errorf("%s: qdma node = %q, want %q", c.name, node.Qdma, c.wantQdma)
+		}
+	}
+}
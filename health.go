@@ -0,0 +1,191 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+// Health thresholds for the XMC sensors, overridable from the command
+// line for boards with different envelopes. Zero disables a check.
+var (
+	// maxTemp is the FPGA temperature in degrees Celsius above which a
+	// card is reported unhealthy. 90C is conservative: most shells
+	// start throttling just above it.
+	maxTemp uint64 = 90
+	// maxPower is the power draw (in the unit the driver reports,
+	// microwatts on current XRT) above which a card is reported
+	// unhealthy. Disabled by default since envelopes vary per board.
+	maxPower uint64
+	// minFanSpeed is the fan speed in RPM below which a card is
+	// reported unhealthy. Disabled by default; passively cooled boards
+	// report zero.
+	minFanSpeed uint64
+)
+
+// readSensor reads one numeric sensor attribute. ok is false when the
+// board doesn't expose the sensor or the value isn't numeric, in which
+// case that check is skipped rather than failing the card.
+func readSensor(fname string) (uint64, bool) {
+	content, err := GetFileContent(fname)
+	if err != nil {
+		return 0, false
+	}
+	val, err := strconv.ParseUint(content, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return val, true
+}
+
+// gradeSensors grades a card's health from the sensor attributes in
+// xmcDir against the configured thresholds.
+func gradeSensors(pciID, xmcDir string) string {
+	if temp, ok := readSensor(path.Join(xmcDir, XMCTempFile)); ok &&
+		maxTemp != 0 && temp > maxTemp {
+		log.Warnf("Card %s over temperature: %d > %d", pciID, temp, maxTemp)
+		return pluginapi.Unhealthy
+	}
+	if power, ok := readSensor(path.Join(xmcDir, XMCPowerFile)); ok &&
+		maxPower != 0 && power > maxPower {
+		log.Warnf("Card %s over power budget: %d > %d", pciID, power, maxPower)
+		return pluginapi.Unhealthy
+	}
+	if fan, ok := readFanSpeed(xmcDir); ok &&
+		minFanSpeed != 0 && fan < minFanSpeed {
+		log.Warnf("Card %s fan too slow: %d < %d", pciID, fan, minFanSpeed)
+		return pluginapi.Unhealthy
+	}
+	return pluginapi.Healthy
+}
+
+// readFanSpeed reads the fan speed under either of the names XMC
+// firmware has used for it.
+func readFanSpeed(xmcDir string) (uint64, bool) {
+	if fan, ok := readSensor(path.Join(xmcDir, XMCFanSpeedFile)); ok {
+		return fan, true
+	}
+	return readSensor(path.Join(xmcDir, XMCFanRPMFile))
+}
+
+// GetTemperature reads the card's FPGA temperature for reporting,
+// 0 when the board doesn't expose an XMC temperature sensor.
+func GetTemperature(pciID string) uint64 {
+	devDir := locator.DeviceDir(pciID)
+	xmcFolder, err := GetFileNameFromPrefix(devDir, XMCSTR)
+	if err != nil || xmcFolder == "" {
+		return 0
+	}
+	temp, _ := readSensor(path.Join(devDir, xmcFolder, XMCTempFile))
+	return temp
+}
+
+// DeviceTelemetry is one board's live XMC sensor readings. Each Valid
+// flag reports whether the board actually exposes the sensor; older
+// shells miss some or all of them, and an absent sensor must surface as
+// an absent metric rather than a zero reading.
+type DeviceTelemetry struct {
+	Temp       uint64 // FPGA die temperature, degrees Celsius
+	TempValid  bool
+	Power      uint64 // power draw, in the driver's unit (microwatts on current XRT)
+	PowerValid bool
+	FanRPM     uint64
+	FanValid   bool
+}
+
+// GetTelemetry reads the card's XMC sensors for reporting. Boards
+// without an XMC subdevice return a zero value with every Valid flag
+// false.
+func GetTelemetry(pciID string) DeviceTelemetry {
+	var tele DeviceTelemetry
+	devDir := locator.DeviceDir(pciID)
+	xmcFolder, err := GetFileNameFromPrefix(devDir, XMCSTR)
+	if err != nil || xmcFolder == "" {
+		return tele
+	}
+	xmcDir := path.Join(devDir, xmcFolder)
+	tele.Temp, tele.TempValid = readSensor(path.Join(xmcDir, XMCTempFile))
+	tele.Power, tele.PowerValid = readSensor(path.Join(xmcDir, XMCPowerFile))
+	tele.FanRPM, tele.FanValid = readFanSpeed(xmcDir)
+	return tele
+}
+
+// HealthChecker is the extension point for site-specific health logic:
+// ECC counters, AIE array status and the like. Check inspects a
+// discovered device, after its nodes and metadata are filled in, and
+// returns one of the kubelet health strings or HealthDegraded.
+type HealthChecker interface {
+	Check(d *Device) string
+}
+
+// healthCheckers is the chain discovery runs for every card, worst
+// verdict winning. The built-in threshold checker is always first;
+// custom ones are added with RegisterHealthChecker.
+var healthCheckers = []HealthChecker{thresholdChecker{}}
+
+// RegisterHealthChecker appends a custom health source to the chain.
+// Sites compiling in their own checks call this from an init function.
+func RegisterHealthChecker(c HealthChecker) {
+	healthCheckers = append(healthCheckers, c)
+}
+
+// thresholdChecker is the default HealthChecker: it grades every
+// node's XMC sensors against the configured temperature, power and fan
+// thresholds.
+type thresholdChecker struct{}
+
+func (thresholdChecker) Check(d *Device) string {
+	for _, node := range d.Nodes {
+		if node.DBDF == "" {
+			continue
+		}
+		if status, err := CheckHealth(node.DBDF); err == nil && status != pluginapi.Healthy {
+			return status
+		}
+	}
+	return pluginapi.Healthy
+}
+
+// runHealthCheckers combines the chain's verdicts for one device: any
+// Unhealthy wins outright, Degraded beats Healthy.
+func runHealthCheckers(d *Device) string {
+	verdict := pluginapi.Healthy
+	for _, checker := range healthCheckers {
+		switch checker.Check(d) {
+		case pluginapi.Unhealthy:
+			return pluginapi.Unhealthy
+		case HealthDegraded:
+			verdict = HealthDegraded
+		}
+	}
+	return verdict
+}
+
+// CheckHealth grades the card's health from its XMC sensors. Boards
+// without an XMC subdevice, or without a particular sensor, skip the
+// corresponding checks and count as healthy.
+func CheckHealth(pciID string) (string, error) {
+	devDir := locator.DeviceDir(pciID)
+	xmcFolder, err := GetFileNameFromPrefix(devDir, XMCSTR)
+	if err != nil || xmcFolder == "" {
+		return pluginapi.Healthy, nil
+	}
+	return gradeSensors(pciID, path.Join(devDir, xmcFolder)), nil
+}
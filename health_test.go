@@ -0,0 +1,179 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+// writeSensors lays out an xmc fixture directory with the given sensor
+// values; empty values leave the corresponding file absent.
+func writeSensors(t *testing.T, dir, temp, power, fan string) {
+	t.Helper()
+	for fname, val := range map[string]string{
+		XMCTempFile:     temp,
+		XMCPowerFile:    power,
+		XMCFanSpeedFile: fan,
+	} {
+		if val == "" {
+			continue
+		}
+		if err := ioutil.WriteFile(path.Join(dir, fname), []byte(val+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGradeSensors(t *testing.T) {
+	defer func() {
+		maxTemp = 90
+		maxPower = 0
+		minFanSpeed = 0
+	}()
+	maxTemp = 90
+	maxPower = 200000000
+	minFanSpeed = 500
+
+	cases := []struct {
+		name             string
+		temp, power, fan string
+		want             string
+	}{
+		{"all nominal", "60", "75000000", "1500", pluginapi.Healthy},
+		{"over temperature", "104", "75000000", "1500", pluginapi.Unhealthy},
+		{"over power", "60", "225000000", "1500", pluginapi.Unhealthy},
+		{"fan too slow", "60", "75000000", "120", pluginapi.Unhealthy},
+		// a board without a given sensor skips that check
+		{"no sensors at all", "", "", "", pluginapi.Healthy},
+		{"only temperature, nominal", "60", "", "", pluginapi.Healthy},
+		{"garbage reading skipped", "N/A", "", "", pluginapi.Healthy},
+	}
+	for _, c := range cases {
+		dir := t.TempDir()
+		writeSensors(t, dir, c.temp, c.power, c.fan)
+		if got := gradeSensors("0000:65:00.1", dir); got != c.want {
+			t.Errorf("%s: gradeSensors = %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestReadFanSpeedAlias(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(path.Join(dir, XMCFanRPMFile), []byte("1300\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fan, ok := readFanSpeed(dir)
+	if !ok || fan != 1300 {
+		t.Errorf("readFanSpeed = %d, %v, want 1300 via %s", fan, ok, XMCFanRPMFile)
+	}
+}
+
+func TestGradeSensorsDisabledChecks(t *testing.T) {
+	defer func() { maxTemp = 90 }()
+	maxTemp = 0
+
+	dir := t.TempDir()
+	writeSensors(t, dir, "120", "", "")
+	if got := gradeSensors("0000:65:00.1", dir); got != pluginapi.Healthy {
+		t.Errorf("disabled temperature check still failed the card: %s", got)
+	}
+}
+
+// stubChecker is a fixed-verdict HealthChecker for exercising the
+// checker chain.
+type stubChecker struct{ verdict string }
+
+func (s stubChecker) Check(d *Device) string { return s.verdict }
+
+func TestRunHealthCheckers(t *testing.T) {
+	defer func() { healthCheckers = []HealthChecker{thresholdChecker{}} }()
+	device := &Device{sn: "SN-A"}
+
+	// the default chain alone: no nodes, nothing to grade
+	if got := runHealthCheckers(device); got != pluginapi.Healthy {
+		t.Errorf("default verdict = %s", got)
+	}
+
+	RegisterHealthChecker(stubChecker{HealthDegraded})
+	if got := runHealthCheckers(device); got != HealthDegraded {
+		t.Errorf("degraded checker verdict = %s", got)
+	}
+
+	// any Unhealthy wins over Degraded
+	RegisterHealthChecker(stubChecker{pluginapi.Unhealthy})
+	if got := runHealthCheckers(device); got != pluginapi.Unhealthy {
+		t.Errorf("unhealthy checker verdict = %s", got)
+	}
+}
+
+// A registered custom checker's verdict reaches the advertised health
+// of an otherwise healthy, ready card.
+func TestCustomHealthCheckerInDiscovery(t *testing.T) {
+	defer func() {
+		locator = pciLocator{root: SysfsDevices}
+		healthCheckers = []HealthChecker{thresholdChecker{}}
+	}()
+	root := t.TempDir()
+	plantUserPF(t, root, "0000:65:00.1", "SN-A", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+	locator = pciLocator{root: root}
+
+	RegisterHealthChecker(stubChecker{pluginapi.Unhealthy})
+	devices, _, err := GetDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if devices["SN-A"].Healthy != pluginapi.Unhealthy {
+		t.Errorf("custom checker verdict ignored: %s", devices["SN-A"].Healthy)
+	}
+}
+
+func TestGetTelemetry(t *testing.T) {
+	defer func() { locator = pciLocator{root: SysfsDevices} }()
+	root := t.TempDir()
+	locator = pciLocator{root: root}
+
+	// a board exposing temperature and fan speed, but no power sensor
+	xmcDir := path.Join(root, "0000:65:00.1", "xmc.u129")
+	if err := os.MkdirAll(xmcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeSensors(t, xmcDir, "61", "", "1450")
+
+	tele := GetTelemetry("0000:65:00.1")
+	if !tele.TempValid || tele.Temp != 61 {
+		t.Errorf("temp = %d valid %v, want 61", tele.Temp, tele.TempValid)
+	}
+	if tele.PowerValid {
+		t.Errorf("absent power sensor reported valid: %d", tele.Power)
+	}
+	if !tele.FanValid || tele.FanRPM != 1450 {
+		t.Errorf("fan = %d valid %v, want 1450", tele.FanRPM, tele.FanValid)
+	}
+
+	// a board without an XMC subdevice has no telemetry at all
+	if err := os.MkdirAll(path.Join(root, "0000:81:00.1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tele = GetTelemetry("0000:81:00.1")
+	if tele.TempValid || tele.PowerValid || tele.FanValid {
+		t.Errorf("board without XMC reported telemetry: %+v", tele)
+	}
+}
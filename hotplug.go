@@ -0,0 +1,86 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsnotify/fsnotify"
+)
+
+// hotplugDebounce coalesces the burst of inotify events a single
+// hotplug or FLR produces into one rescan.
+const hotplugDebounce = 250 * time.Millisecond
+
+// newHotplugWatcher watches dir (the PCI device directory) with inotify
+// and returns a channel that delivers one signal per debounced burst of
+// events, so the scan loop can rediscover immediately instead of
+// waiting out the poll interval. When inotify is unavailable, e.g. in a
+// restricted container, it returns nil and the caller falls back to
+// periodic polling alone.
+func newHotplugWatcher(dir string) <-chan struct{} {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Warnf("Hotplug watcher unavailable, relying on polling alone: %v", err)
+		return nil
+	}
+	if err := watcher.Add(dir); err != nil {
+		log.Warnf("Can't watch %s, relying on polling alone: %v", dir, err)
+		watcher.Close()
+		return nil
+	}
+	// best effort: also watch the per-device ready files so a shell
+	// becoming ready is picked up; attribute writes are not reported
+	// for every driver, and polling still covers those
+	if pciIDs, err := locator.DeviceIDs(); err == nil {
+		for _, pciID := range pciIDs {
+			watcher.Add(path.Join(locator.DeviceDir(pciID), ReadyFile))
+		}
+	}
+
+	kicks := make(chan struct{}, 1)
+	go func() {
+		debounce := time.NewTimer(hotplugDebounce)
+		if !debounce.Stop() {
+			<-debounce.C
+		}
+		pending := false
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if pending && !debounce.Stop() {
+					<-debounce.C
+				}
+				debounce.Reset(hotplugDebounce)
+				pending = true
+			case err := <-watcher.Errors:
+				log.Debugf("Hotplug watcher: %v", err)
+			case <-debounce.C:
+				pending = false
+				select {
+				case kicks <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return kicks
+}
@@ -0,0 +1,66 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestHotplugWatcherDebounces(t *testing.T) {
+	dir := t.TempDir()
+	kicks := newHotplugWatcher(dir)
+	if kicks == nil {
+		t.Skip("inotify unavailable in this environment")
+	}
+
+	// a burst of events must coalesce into a single kick
+	for i := 0; i < 5; i++ {
+		fname := path.Join(dir, fmt.Sprintf("0000:6%d:00.1", i))
+		if err := ioutil.WriteFile(fname, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-kicks:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no kick after sysfs events")
+	}
+	select {
+	case <-kicks:
+		t.Error("burst of events produced more than one kick")
+	case <-time.After(2 * hotplugDebounce):
+	}
+
+	// a later event kicks again
+	if err := ioutil.WriteFile(path.Join(dir, "0000:d8:00.1"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-kicks:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no kick after a later event")
+	}
+}
+
+func TestHotplugWatcherMissingDir(t *testing.T) {
+	if kicks := newHotplugWatcher("/nonexistent/pci/devices"); kicks != nil {
+		t.Error("expected nil channel when the directory can't be watched")
+	}
+}
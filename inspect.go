@@ -0,0 +1,95 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// InventoryView is what the introspection endpoint serves: the exported
+// device views grouped by DSA type, plus when the snapshot was taken so
+// consumers can tell a stale answer from a fresh one.
+type InventoryView struct {
+	Taken     time.Time                        `json:"taken"`
+	Resources map[string]map[string]DeviceView `json:"resources"`
+}
+
+// inventory holds the last published snapshot. Requests serve this
+// cached copy; they never trigger a sysfs walk of their own.
+var inventory struct {
+	sync.Mutex
+	view *InventoryView
+}
+
+// publishInventory replaces the served snapshot. Called from the main
+// loop after every device update, alongside the metric exporters.
+func publishInventory(devices map[string]map[string]Device) {
+	view := &InventoryView{
+		Taken:     time.Now(),
+		Resources: make(map[string]map[string]DeviceView, len(devices)),
+	}
+	for dsaType, subMap := range devices {
+		views := make(map[string]DeviceView, len(subMap))
+		for sn, device := range subMap {
+			views[sn] = viewOf(device)
+		}
+		view.Resources[dsaType] = views
+	}
+	inventory.Lock()
+	inventory.view = view
+	inventory.Unlock()
+}
+
+// inventoryHandler serves the cached snapshot as JSON. Before the first
+// scan completes there is nothing to report yet.
+func inventoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "read-only endpoint", http.StatusMethodNotAllowed)
+		return
+	}
+	inventory.Lock()
+	view := inventory.view
+	inventory.Unlock()
+	if view == nil {
+		http.Error(w, "no scan completed yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(view); err != nil {
+		log.Debugf("Inventory response dropped: %v", err)
+	}
+}
+
+// startInspectServer serves the device inventory on addr under
+// /inventory, e.g. 127.0.0.1:9102. An empty addr disables the endpoint.
+func startInspectServer(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/inventory", inventoryHandler)
+	go func() {
+		log.Printf("Serving device inventory on %s/inventory", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Errorf("Inventory listener failed: %v", err)
+		}
+	}()
+}
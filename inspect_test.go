@@ -0,0 +1,86 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+func TestInventoryHandler(t *testing.T) {
+	defer func() {
+		inventory.Lock()
+		inventory.view = nil
+		inventory.Unlock()
+	}()
+	inventory.Lock()
+	inventory.view = nil
+	inventory.Unlock()
+
+	// before the first scan there is nothing to serve
+	rec := httptest.NewRecorder()
+	inventoryHandler(rec, httptest.NewRequest("GET", "/inventory", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("empty snapshot served %d, want 503", rec.Code)
+	}
+
+	publishInventory(map[string]map[string]Device{
+		"xilinx_u250_xdma_201830_2-1561465320": {
+			"serialA": {
+				sn:        "serialA",
+				shellVer:  "xilinx_u250_xdma_201830_2",
+				timestamp: "1561465320",
+				Healthy:   pluginapi.Healthy,
+				Nodes:     []Node{{DBDF: "0000:65:00.1", User: "/dev/dri/renderD128"}},
+			},
+		},
+	})
+
+	rec = httptest.NewRecorder()
+	inventoryHandler(rec, httptest.NewRequest("GET", "/inventory", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	var view InventoryView
+	if err := json.Unmarshal(rec.Body.Bytes(), &view); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(view.Taken) > time.Minute || view.Taken.IsZero() {
+		t.Errorf("snapshot timestamp %v not recent", view.Taken)
+	}
+	device, ok := view.Resources["xilinx_u250_xdma_201830_2-1561465320"]["serialA"]
+	if !ok {
+		t.Fatalf("card missing from inventory: %s", rec.Body.String())
+	}
+	if device.ShellVersion != "xilinx_u250_xdma_201830_2" || device.Health != pluginapi.Healthy {
+		t.Errorf("device view = %+v", device)
+	}
+	if len(device.Nodes) != 1 || device.Nodes[0].User != "/dev/dri/renderD128" {
+		t.Errorf("node paths = %+v", device.Nodes)
+	}
+
+	// the endpoint is read-only
+	rec = httptest.NewRecorder()
+	inventoryHandler(rec, httptest.NewRequest("POST", "/inventory", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST served %d, want 405", rec.Code)
+	}
+}
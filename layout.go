@@ -0,0 +1,165 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// resolvedLayout records where a given driver version places the
+// per-card metadata below a PCI device directory, so GetDevices works
+// across driver versions without scattering per-version branches.
+type resolvedLayout struct {
+	name          string // layout variant, for debugging
+	serialPath    string
+	vbnvPath      string
+	timestampPath string
+	qdmaPrefix    string // name prefix of qdma subdev folders
+}
+
+// layoutCache remembers the detected layout per device directory, so
+// the probing happens once per card rather than on every scan.
+var layoutCache = struct {
+	sync.Mutex
+	m map[string]*resolvedLayout
+}{m: make(map[string]*resolvedLayout)}
+
+// probeClassicLayout matches the 2018.3+ xclmgmt/xocl layout with
+// xmc.u* and rom.u* subdevice folders.
+func probeClassicLayout(dir string) *resolvedLayout {
+	xmcFolder, err := GetFileNameFromPrefix(dir, XMCSTR)
+	if err != nil || xmcFolder == "" {
+		return nil
+	}
+	romFolder, err := GetFileNameFromPrefix(dir, ROMSTR)
+	if err != nil || romFolder == "" {
+		return nil
+	}
+	return &resolvedLayout{
+		name:          "classic",
+		serialPath:    path.Join(dir, xmcFolder, SerialNumFile),
+		vbnvPath:      path.Join(dir, romFolder, DSAverFile),
+		timestampPath: path.Join(dir, romFolder, DSAtsFile),
+		qdmaPrefix:    QDMASTR,
+	}
+}
+
+// probeHBMLayout matches the xrt drivers shipped for the HBM Alveo
+// cards (U50, U55C), which dropped the rom.u* folder and keep the shell
+// metadata in an xmgmt_main.u* partition folder instead.
+func probeHBMLayout(dir string) *resolvedLayout {
+	xmcFolder, err := GetFileNameFromPrefix(dir, XMCSTR)
+	if err != nil || xmcFolder == "" {
+		return nil
+	}
+	xmgmtFolder, err := GetFileNameFromPrefix(dir, XMGMTSTR)
+	if err != nil || xmgmtFolder == "" {
+		return nil
+	}
+	if !FileExist(path.Join(dir, xmgmtFolder, DSAverFile)) {
+		return nil
+	}
+	return &resolvedLayout{
+		name:          "hbm",
+		serialPath:    path.Join(dir, xmcFolder, SerialNumFile),
+		vbnvPath:      path.Join(dir, xmgmtFolder, DSAverFile),
+		timestampPath: path.Join(dir, xmgmtFolder, DSAtsFile),
+		qdmaPrefix:    QDMASTR,
+	}
+}
+
+// probeFlatLayout matches driver builds that expose the metadata as
+// plain attributes directly in the device directory.
+func probeFlatLayout(dir string) *resolvedLayout {
+	if !FileExist(path.Join(dir, DSAverFile)) ||
+		!FileExist(path.Join(dir, SerialNumFile)) {
+		return nil
+	}
+	return &resolvedLayout{
+		name:          "flat",
+		serialPath:    path.Join(dir, SerialNumFile),
+		vbnvPath:      path.Join(dir, DSAverFile),
+		timestampPath: path.Join(dir, DSAtsFile),
+		qdmaPrefix:    QDMASTR,
+	}
+}
+
+// probeAdvantechLayout matches Advantech accelerator cards, whose
+// driver does not create the Xilinx xmc.u*/rom.u* subdevice folders and
+// instead exposes the board metadata as plain attributes in the device
+// directory under its own names. The build date is optional; older
+// firmware does not report one.
+func probeAdvantechLayout(dir string) *resolvedLayout {
+	if !FileExist(path.Join(dir, AdvantechSerialFile)) ||
+		!FileExist(path.Join(dir, AdvantechShellFile)) {
+		return nil
+	}
+	timestampPath := path.Join(dir, AdvantechTsFile)
+	if !FileExist(timestampPath) {
+		timestampPath = ""
+	}
+	return &resolvedLayout{
+		name:          "advantech",
+		serialPath:    path.Join(dir, AdvantechSerialFile),
+		vbnvPath:      path.Join(dir, AdvantechShellFile),
+		timestampPath: timestampPath,
+		qdmaPrefix:    QDMASTR,
+	}
+}
+
+// valid reports whether a cached layout still matches the filesystem,
+// e.g. after a driver upgrade changed the subdevice naming.
+func (l *resolvedLayout) valid() bool {
+	return FileExist(l.serialPath) && FileExist(l.vbnvPath)
+}
+
+// resolveLayout probes the known layout variants for the given device
+// directory, using the cached result when it is still valid. The vendor
+// ID selects which variants apply: Advantech boards get their own probe
+// tried first (some of their cards rebadge a Xilinx design and keep the
+// Xilinx layout, so the generic probes remain as fallback), while
+// Xilinx-ID cards only see the generic probes.
+func resolveLayout(dir, vendorID string) (*resolvedLayout, error) {
+	layoutCache.Lock()
+	defer layoutCache.Unlock()
+	if layout, ok := layoutCache.m[dir]; ok && layout.valid() {
+		return layout, nil
+	}
+	// classic wins when rom.u* is present; the HBM variant covers cards
+	// that dropped it; flat is the last resort
+	probes := []func(string) *resolvedLayout{
+		probeClassicLayout,
+		probeHBMLayout,
+		probeFlatLayout,
+	}
+	if strings.EqualFold(vendorID, ADVANTECH_ID) {
+		probes = append([]func(string) *resolvedLayout{probeAdvantechLayout}, probes...)
+	}
+	for _, probe := range probes {
+		if layout := probe(dir); layout != nil {
+			log.Debugf("Device %s uses %s sysfs layout", dir, layout.name)
+			layoutCache.m[dir] = layout
+			return layout, nil
+		}
+	}
+	delete(layoutCache.m, dir)
+	return nil, fmt.Errorf("no known sysfs layout found under %s", dir)
+}
@@ -0,0 +1,212 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// writeFixture creates the given files (relative to dir) with dummy
+// content, making parent directories as needed.
+func writeFixture(t *testing.T, dir string, files ...string) {
+	t.Helper()
+	for _, f := range files {
+		fname := path.Join(dir, f)
+		if err := os.MkdirAll(path.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, []byte("x\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResolveLayoutClassic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcidev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFixture(t, dir,
+		"xmc.u1536/serial_num",
+		"rom.u1792/VBNV",
+		"rom.u1792/timestamp")
+
+	layout, err := resolveLayout(dir, XilinxVendorID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.name != "classic" {
+		t.Errorf("expected classic layout, got %s", layout.name)
+	}
+	if layout.serialPath != path.Join(dir, "xmc.u1536", SerialNumFile) {
+		t.Errorf("wrong serial path %s", layout.serialPath)
+	}
+	if layout.vbnvPath != path.Join(dir, "rom.u1792", DSAverFile) {
+		t.Errorf("wrong VBNV path %s", layout.vbnvPath)
+	}
+}
+
+func TestResolveLayoutHBM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcidev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a U50-style card: no rom.u* folder, shell metadata under
+	// xmgmt_main.u*
+	writeFixture(t, dir,
+		"xmc.u1536/serial_num",
+		"xmgmt_main.u1792/VBNV",
+		"xmgmt_main.u1792/timestamp")
+
+	layout, err := resolveLayout(dir, XilinxVendorID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.name != "hbm" {
+		t.Errorf("expected hbm layout, got %s", layout.name)
+	}
+	if layout.vbnvPath != path.Join(dir, "xmgmt_main.u1792", DSAverFile) {
+		t.Errorf("wrong VBNV path %s", layout.vbnvPath)
+	}
+	if layout.timestampPath != path.Join(dir, "xmgmt_main.u1792", DSAtsFile) {
+		t.Errorf("wrong timestamp path %s", layout.timestampPath)
+	}
+}
+
+func TestResolveLayoutFlat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcidev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFixture(t, dir, "serial_num", "VBNV", "timestamp")
+
+	layout, err := resolveLayout(dir, XilinxVendorID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.name != "flat" {
+		t.Errorf("expected flat layout, got %s", layout.name)
+	}
+	if layout.serialPath != path.Join(dir, SerialNumFile) {
+		t.Errorf("wrong serial path %s", layout.serialPath)
+	}
+}
+
+func TestResolveLayoutAdvantech(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcidev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFixture(t, dir, AdvantechSerialFile, AdvantechShellFile)
+
+	layout, err := resolveLayout(dir, ADVANTECH_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.name != "advantech" {
+		t.Errorf("expected advantech layout, got %s", layout.name)
+	}
+	if layout.serialPath != path.Join(dir, AdvantechSerialFile) {
+		t.Errorf("wrong serial path %s", layout.serialPath)
+	}
+	if layout.timestampPath != "" {
+		t.Errorf("expected blank timestamp path without %s, got %s",
+			AdvantechTsFile, layout.timestampPath)
+	}
+	// the Advantech attribute names must not be honored for Xilinx-ID
+	// cards; those stay on the existing probes
+	xlnxDir, err := ioutil.TempDir("", "pcidev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(xlnxDir)
+	writeFixture(t, xlnxDir, AdvantechSerialFile, AdvantechShellFile)
+	if _, err := resolveLayout(xlnxDir, XilinxVendorID); err == nil {
+		t.Error("expected Xilinx vendor to reject the Advantech layout")
+	}
+}
+
+func TestResolveLayoutAdvantechRebadged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcidev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// an Advantech card that rebadges a Xilinx design and kept the
+	// classic layout falls through to the generic probes
+	writeFixture(t, dir,
+		"xmc.u1536/serial_num",
+		"rom.u1792/VBNV",
+		"rom.u1792/timestamp")
+
+	layout, err := resolveLayout(dir, ADVANTECH_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.name != "classic" {
+		t.Errorf("expected classic layout fallback, got %s", layout.name)
+	}
+}
+
+func TestResolveLayoutCacheInvalidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcidev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFixture(t, dir,
+		"xmc.u1536/serial_num",
+		"rom.u1792/VBNV",
+		"rom.u1792/timestamp")
+
+	if _, err := resolveLayout(dir, XilinxVendorID); err != nil {
+		t.Fatal(err)
+	}
+	// simulate a driver upgrade switching the card to the flat layout
+	if err := os.RemoveAll(path.Join(dir, "xmc.u1536")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(path.Join(dir, "rom.u1792")); err != nil {
+		t.Fatal(err)
+	}
+	writeFixture(t, dir, "serial_num", "VBNV", "timestamp")
+
+	layout, err := resolveLayout(dir, XilinxVendorID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.name != "flat" {
+		t.Errorf("expected re-probe to find flat layout, got %s", layout.name)
+	}
+}
+
+func TestResolveLayoutUnknown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcidev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := resolveLayout(dir, XilinxVendorID); err == nil {
+		t.Error("expected error for unknown layout")
+	}
+}
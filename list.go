@@ -0,0 +1,144 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// NodeView and DeviceView are the exported shapes of Node and Device
+// used by the -list debugging output; the internal structs keep their
+// unexported fields.
+type NodeView struct {
+	DBDF         string   `json:"dbdf"`
+	User         string   `json:"user,omitempty"`
+	SubdevPath   string   `json:"subdevPath,omitempty"`
+	SubdevNodes  []string `json:"subdevNodes,omitempty"`
+	ExtraDevices []string `json:"extraDevices,omitempty"`
+	Qdma         string   `json:"qdma,omitempty"`
+	Qdmas        []string `json:"qdmas,omitempty"`
+	AWSSlot      string   `json:"awsSlot,omitempty"`
+	NUMA         int      `json:"numa"`
+	ParentSwitch string   `json:"parentSwitch,omitempty"`
+	DeviceID     string   `json:"deviceID,omitempty"`
+}
+
+type DeviceView struct {
+	SerialNumber string `json:"serialNumber"`
+	ShellVersion string `json:"shellVersion"`
+	// ShellParsed is the VBNV broken into components, omitted when the
+	// raw string doesn't parse
+	ShellParsed *VBNV  `json:"shellParsed,omitempty"`
+	Timestamp   string `json:"timestamp"`
+	// TimestampValue is the timestamp parsed to a number, 0 when the
+	// raw string doesn't parse
+	TimestampValue uint64     `json:"timestampValue,omitempty"`
+	XclbinUUID     string     `json:"xclbinUUID,omitempty"`
+	CUCount        int        `json:"cuCount,omitempty"`
+	Health         string     `json:"health"`
+	DegradedReason string     `json:"degradedReason,omitempty"`
+	RecoveryAction string     `json:"recoveryAction,omitempty"`
+	PowerProfile   string     `json:"powerProfile,omitempty"`
+	ClockFreqs     string     `json:"clockFreqs,omitempty"`
+	TempCelsius    uint64     `json:"tempCelsius,omitempty"`
+	Resource       string     `json:"resource"`
+	Nodes          []NodeView `json:"nodes"`
+}
+
+// viewOf converts a discovered Device into its exported view.
+func viewOf(device Device) DeviceView {
+	view := DeviceView{
+		SerialNumber:   device.sn,
+		ShellVersion:   device.shellVer,
+		Timestamp:      device.timestamp,
+		TimestampValue: device.tsValue,
+		XclbinUUID:     device.xclbinUUID,
+		CUCount:        device.cuCount,
+		Health:         device.Healthy,
+		DegradedReason: device.degradedReason,
+		RecoveryAction: device.recoveryAction,
+		PowerProfile:   device.powerProfile,
+		ClockFreqs:     device.clockFreqs,
+		TempCelsius:    device.temp,
+		Resource:       resourceNamePrefix + "-" + resourceNameOf(device),
+	}
+	if device.vbnv != (VBNV{}) {
+		vbnv := device.vbnv
+		view.ShellParsed = &vbnv
+	}
+	for _, node := range device.Nodes {
+		view.Nodes = append(view.Nodes, NodeView{
+			DBDF:         node.DBDF,
+			User:         node.User,
+			SubdevPath:   node.SubdevPath,
+			SubdevNodes:  node.SubdevNodes,
+			ExtraDevices: node.ExtraDevices,
+			Qdma:         node.Qdma,
+			Qdmas:        node.Qdmas,
+			AWSSlot:      node.AWSSlot,
+			NUMA:         node.NUMA,
+			ParentSwitch: node.ParentSwitch,
+			DeviceID:     node.deviceID,
+		})
+	}
+	return view
+}
+
+// runList prints what discovery sees on this box, for debugging without
+// kubelet. Returns the process exit code.
+func runList(format string) int {
+	devices, diags, err := ScanDevices()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	for _, diag := range diags {
+		fmt.Fprintf(os.Stderr, "%s\n", diag.Error())
+	}
+
+	views := make(map[string]DeviceView, len(devices))
+	for sn, device := range devices {
+		views[sn] = viewOf(device)
+	}
+
+	switch format {
+	case "json":
+		buf, err := json.MarshalIndent(views, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		fmt.Println(string(buf))
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 2, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "SERIAL\tSHELL\tTIMESTAMP\tHEALTH\tBDF\tUSER\tQDMA")
+		for _, view := range views {
+			for _, node := range view.Nodes {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+					view.SerialNumber, view.ShellVersion, view.Timestamp,
+					view.Health, node.DBDF, node.User, node.Qdma)
+			}
+		}
+		w.Flush()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q, expect json or table\n", format)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,61 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+func TestViewOfJSON(t *testing.T) {
+	device := Device{
+		sn:        "serialA",
+		shellVer:  "xilinx_u250_xdma_201830_2",
+		timestamp: "1561465320",
+		Healthy:   pluginapi.Healthy,
+		Nodes: []Node{{
+			DBDF:     "0000:65:00.1",
+			User:     "/dev/dri/renderD128",
+			Qdma:     "/dev/xfpga/dma.qdma.u25857",
+			NUMA:     -1,
+			deviceID: "0x5001",
+		}},
+	}
+
+	buf, err := json.MarshalIndent(viewOf(device), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(buf)
+	// the unexported internals must come out under scriptable keys
+	for _, want := range []string{
+		`"serialNumber": "serialA"`,
+		`"shellVersion": "xilinx_u250_xdma_201830_2"`,
+		`"timestamp": "1561465320"`,
+		`"health": "Healthy"`,
+		`"dbdf": "0000:65:00.1"`,
+		`"user": "/dev/dri/renderD128"`,
+		`"qdma": "/dev/xfpga/dma.qdma.u25857"`,
+		`"deviceID": "0x5001"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("dump missing %s:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// XfpgaClassDir is where newer XRT versions expose per-device class
+// entries when the PCI device directories are not usable directly.
+var XfpgaClassDir = "/sys/class/xfpga"
+
+// sysfsLocator abstracts where the per-device attribute directories
+// live, so GetDevices works unchanged across sysfs layouts.
+type sysfsLocator interface {
+	// Name identifies the locator in logs.
+	Name() string
+	// DeviceIDs returns the BDFs of candidate devices, sorted.
+	DeviceIDs() ([]string, error)
+	// DeviceDir returns the attribute directory for one BDF.
+	DeviceDir(pciID string) string
+}
+
+// locator is the detected layout; the PCI one is the default so code
+// paths that run before detection (and the tests) see the historical
+// behavior.
+var locator sysfsLocator = pciLocator{root: SysfsDevices}
+
+// pciLocator is the classic /sys/bus/pci/devices layout.
+type pciLocator struct {
+	root string
+}
+
+func (l pciLocator) Name() string { return "pci" }
+
+func (l pciLocator) DeviceIDs() ([]string, error) {
+	files, err := fsys.ReadDir(l.root)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(files))
+	for _, file := range files {
+		ids = append(ids, file.Name())
+	}
+	return ids, nil
+}
+
+func (l pciLocator) DeviceDir(pciID string) string {
+	return path.Join(l.root, pciID)
+}
+
+// xfpgaLocator derives the device directories from the symlinks under
+// /sys/class/xfpga, for hosts where the PCI tree is not available.
+// Each class entry links into the PCI hierarchy; the BDF component of
+// the resolved path identifies the card.
+type xfpgaLocator struct {
+	root string
+	dirs map[string]string // BDF -> device attribute directory
+}
+
+func (l *xfpgaLocator) Name() string { return "xfpga-class" }
+
+func (l *xfpgaLocator) DeviceIDs() ([]string, error) {
+	entries, err := ioutil.ReadDir(l.root)
+	if err != nil {
+		return nil, err
+	}
+	l.dirs = make(map[string]string)
+	for _, entry := range entries {
+		resolved, err := filepath.EvalSymlinks(path.Join(l.root, entry.Name()))
+		if err != nil {
+			continue
+		}
+		// walk up until the BDF-named directory of the function
+		for dir := resolved; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+			if base := filepath.Base(dir); bdfPattern.MatchString(base) {
+				l.dirs[base] = dir
+				break
+			}
+		}
+	}
+	ids := make([]string, 0, len(l.dirs))
+	for id := range l.dirs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (l *xfpgaLocator) DeviceDir(pciID string) string {
+	if dir, ok := l.dirs[pciID]; ok {
+		return dir
+	}
+	// fall back to the classic location for IDs not seen via the class
+	// entries (e.g. mgmt PFs)
+	return path.Join(SysfsDevices, pciID)
+}
+
+// detectSysfsLocator picks the layout present on this host, preferring
+// the PCI tree for backward compatibility when both exist.
+func detectSysfsLocator() sysfsLocator {
+	if _, err := os.Stat(SysfsDevices); err == nil {
+		return pciLocator{root: SysfsDevices}
+	}
+	if _, err := os.Stat(XfpgaClassDir); err == nil {
+		log.Printf("PCI device tree not found, using %s", XfpgaClassDir)
+		return &xfpgaLocator{root: XfpgaClassDir}
+	}
+	// neither present: keep the classic locator so the error surfaces
+	// through the usual GetDevices path
+	return pciLocator{root: SysfsDevices}
+}
@@ -0,0 +1,80 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPciLocator(t *testing.T) {
+	root := t.TempDir()
+	for _, bdf := range []string{"0000:65:00.0", "0000:65:00.1"} {
+		if err := os.Mkdir(path.Join(root, bdf), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l := pciLocator{root: root}
+	ids, err := l.DeviceIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] != "0000:65:00.0" {
+		t.Errorf("DeviceIDs = %v", ids)
+	}
+	if dir := l.DeviceDir("0000:65:00.1"); dir != path.Join(root, "0000:65:00.1") {
+		t.Errorf("DeviceDir = %q", dir)
+	}
+}
+
+func TestXfpgaLocator(t *testing.T) {
+	root := t.TempDir()
+	// the real device directory sits inside the PCI hierarchy; the
+	// class entry links to a subdirectory of it
+	devDir := path.Join(root, "pci0000:64", "0000:65:00.1")
+	if err := os.MkdirAll(path.Join(devDir, "xfpga"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(devDir, VendorFile), []byte(XilinxVendorID+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	classDir := path.Join(root, "class", "xfpga")
+	if err := os.MkdirAll(classDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(path.Join(devDir, "xfpga"), path.Join(classDir, "xvc_pub.u25857")); err != nil {
+		t.Fatal(err)
+	}
+
+	l := &xfpgaLocator{root: classDir}
+	ids, err := l.DeviceIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != "0000:65:00.1" {
+		t.Fatalf("DeviceIDs = %v", ids)
+	}
+	if dir := l.DeviceDir("0000:65:00.1"); dir != devDir {
+		t.Errorf("DeviceDir = %q, want %q", dir, devDir)
+	}
+	// unknown IDs fall back to the classic PCI location
+	if dir := l.DeviceDir("0000:d8:00.1"); dir != path.Join(SysfsDevices, "0000:d8:00.1") {
+		t.Errorf("fallback DeviceDir = %q", dir)
+	}
+}
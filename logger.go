@@ -0,0 +1,60 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+// Logger is the leveled logging surface the discovery code emits its
+// operational events through (card discovered, card skipped, health
+// transition). Embedders of the discovery code can inject their own
+// implementation via SetLogger.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// logrusLogger is the default Logger, forwarding to the process-wide
+// logrus logger the rest of the plugin uses.
+type logrusLogger struct{}
+
+func (logrusLogger) Debugf(format string, args ...interface{}) { log.Debugf(format, args...) }
+func (logrusLogger) Infof(format string, args ...interface{})  { log.Infof(format, args...) }
+func (logrusLogger) Warnf(format string, args ...interface{})  { log.Warnf(format, args...) }
+func (logrusLogger) Errorf(format string, args ...interface{}) { log.Errorf(format, args...) }
+
+// nopLogger discards everything.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+func (nopLogger) Warnf(format string, args ...interface{})  {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+
+// logger is what the discovery code logs through.
+var logger Logger = logrusLogger{}
+
+// SetLogger replaces the discovery logger. A nil l silences discovery
+// logging entirely.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	logger = l
+}
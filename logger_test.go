@@ -0,0 +1,79 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// captureLogger records formatted messages per level.
+type captureLogger struct {
+	infos, warns []string
+}
+
+func (l *captureLogger) Debugf(format string, args ...interface{}) {}
+func (l *captureLogger) Infof(format string, args ...interface{}) {
+	l.infos = append(l.infos, fmt.Sprintf(format, args...))
+}
+func (l *captureLogger) Warnf(format string, args ...interface{}) {
+	l.warns = append(l.warns, fmt.Sprintf(format, args...))
+}
+func (l *captureLogger) Errorf(format string, args ...interface{}) {}
+
+func TestDiscoveryLogger(t *testing.T) {
+	defer func() {
+		locator = pciLocator{root: SysfsDevices}
+		SetLogger(logrusLogger{})
+	}()
+
+	root := t.TempDir()
+	plantUserPF(t, root, "0000:65:00.1", "SN-A", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+	plantUserPF(t, root, "0000:d8:00.1", "SN-B", "xilinx_u250_xdma_201830_2", "1561465320", "0x0")
+	locator = pciLocator{root: root}
+
+	captured := &captureLogger{}
+	SetLogger(captured)
+	if _, _, err := GetDevices(); err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, msg := range captured.infos {
+		if strings.Contains(msg, "SN-A") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no Info for the discovered card, got %v", captured.infos)
+	}
+	found = false
+	for _, msg := range captured.warns {
+		if strings.Contains(msg, "0000:d8:00.1") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no Warn for the skipped card, got %v", captured.warns)
+	}
+
+	// a nil logger silences discovery without breaking it
+	SetLogger(nil)
+	if _, _, err := GetDevices(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -16,7 +16,10 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
 
 	log "github.com/Sirupsen/logrus"
@@ -24,19 +27,299 @@ import (
 	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
 )
 
+// applyPathPrefixes rebases the sysfs and /dev paths onto the given
+// roots, for containers where the host filesystems are mounted at e.g.
+// /host-sys. Empty roots keep the host-absolute defaults.
+func applyPathPrefixes(sysfsRoot, devRoot string) {
+	if sysfsRoot != "" {
+		SysfsDevices = filepath.Join(sysfsRoot, "bus", "pci", "devices")
+		XfpgaClassDir = filepath.Join(sysfsRoot, "class", "xfpga")
+		// the default locator captured the old root at init time
+		locator = pciLocator{root: SysfsDevices}
+	}
+	if devRoot != "" {
+		UserPrefix = filepath.Join(devRoot, "dri")
+		SubdevPrefix = filepath.Join(devRoot, "xfpga")
+		awsDevRoot = devRoot
+	}
+}
+
+// applyNodePrefixes overrides the exact directories the device nodes
+// live in, for udev rules that relocate them outright rather than
+// mounting the whole host /dev elsewhere. It runs after
+// applyPathPrefixes, so an explicit prefix wins over the -dev-root
+// rebase. Empty prefixes change nothing.
+func applyNodePrefixes(userPrefix, subdevPrefix string) {
+	if userPrefix != "" {
+		UserPrefix = userPrefix
+	}
+	if subdevPrefix != "" {
+		SubdevPrefix = subdevPrefix
+	}
+}
+
+// reloadConfig re-applies the reloadable parts of the configuration
+// without a process restart. Each piece is validated first; when a new
+// value is invalid the previous one is kept.
+func reloadConfig(allocConfig, extraDevices, flagBDFs string) {
+	if allocConfig != "" {
+		if err := loadAllocExtras(allocConfig); err != nil {
+			log.Warnf("Keeping previous alloc config: %s", err)
+		} else {
+			log.Infof("Reloaded alloc config %s.", allocConfig)
+		}
+	}
+	if extraDevices != "" {
+		if err := loadExtraDeviceRules(extraDevices); err != nil {
+			log.Warnf("Keeping previous extra devices config: %s", err)
+		} else {
+			log.Infof("Reloaded extra devices config %s.", extraDevices)
+		}
+	}
+	// the BDF allowlist follows the environment unless pinned by flag
+	if flagBDFs == "" {
+		set, err := parseBDFList(os.Getenv("FPGA_INCLUDE_BDFS"))
+		if err != nil {
+			log.Warnf("Keeping previous BDF allowlist: %s", err)
+		} else {
+			includeBDFs = set
+		}
+	}
+}
+
 func main() {
 	// Parse command-line arguments
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	flagLogLevel := flag.String("log-level", "info", "Define the logging level: error, info, debug.")
+	flagVerbosity := flag.Int("v", 0, "Verbosity: at 0 only errors and lifecycle events appear, at 4 and above every per-board discovery decision is logged with its BDF. Overrides -log-level when nonzero.")
+	flagLogFormat := flag.String("log-format", "", "Log output format: text or json. Defaults to text; the LOG_FORMAT environment variable is honored when the flag is unset.")
+	flagOTelEndpoint := flag.String("otel-endpoint", "", "OTLP/HTTP endpoint to export device metrics to, e.g. http://collector:4318/v1/metrics. Empty disables export.")
+	flagExpectedXclbins := flag.String("expected-xclbin", "", "Comma separated shell=uuid pairs. Cards running the given shell with a different xclbin loaded are flagged with a warning.")
+	flagExpectedShells := flag.String("expected-shell", "", "Comma separated deviceid=vbnv pairs, e.g. 0x5001=xilinx_u250_xdma_201830_2. Boards of the given device id running a different shell are reported unhealthy.")
+	flagAllocConfig := flag.String("alloc-config", "", "JSON file mapping a card serial number to extra envs and mounts applied during Allocate.")
+	flagExtraDevices := flag.String("extra-devices", "", "JSON file mapping a shell version to glob patterns of additional device nodes to mount during Allocate. Relative patterns expand under the subdev prefix.")
+	flag.DurationVar(&scanInterval, "poll-interval", scanInterval, "How often to poll sysfs for device presence and health changes.")
+	flag.IntVar(&discoveryConcurrency, "concurrency", discoveryConcurrency, "How many PCI functions are probed in parallel during a scan. 1 walks the bus serially.")
+	flag.DurationVar(&settlePeriod, "settle-period", 0, "How long a freshly appeared card must stay healthy before it is advertised. 0 advertises immediately.")
+	flag.IntVar(&healthDebounceScans, "health-debounce", healthDebounceScans, "Number of consecutive scans a device must report the same health state before the advertised health changes. 1 applies changes immediately.")
+	flag.IntVar(&bootRetries, "boot-retries", bootRetries, "How many times the first scan re-polls a card's ready and metadata attributes while the board is still initializing after boot. 0 disables the boot-time retry.")
+	flag.DurationVar(&bootRetryDelay, "boot-retry-delay", bootRetryDelay, "Delay between boot-time re-polls of a card's ready and metadata attributes.")
+	flagMinTimestamps := flag.String("min-timestamp", "", "Comma separated shell=timestamp pairs. Cards running the given shell with an older DSA timestamp are not advertised.")
+	flag.BoolVar(&requireMgmtPF, "require-mgmt", false, "Only advertise cards whose mgmt PF is also visible on the host.")
+	flag.BoolVar(&cuSharing, "cu-sharing", false, "Advertise each card once per compute unit of its loaded xclbin, allowing CU-level sharing.")
+	flag.IntVar(&oversubscribe, "oversubscribe", oversubscribe, "Advertise each card this many times so up to N pods can share it. 1 keeps cards exclusive.")
+	flag.IntVar(&oversubscribe, "device-split", oversubscribe, "Alias for -oversubscribe, matching the GPU shared-device naming.")
+	flag.StringVar(&shellFilter, "shell-filter", "", "Only advertise cards whose shell version matches, exactly or as a glob pattern, e.g. xilinx_u250_*. Empty advertises all shells.")
+	flagIncludeBDFs := flag.String("include-bdfs", "", "Comma separated BDF allowlist restricting discovery to the listed devices. Defaults to the FPGA_INCLUDE_BDFS environment variable.")
+	flag.Int64Var(&maxAttrSize, "max-attr-size", maxAttrSize, "Maximum size in bytes of a large sysfs attribute read.")
+	flag.BoolVar(&capabilityPools, "capability-pools", false, "Additionally advertise cards under a generic pool and capability-tagged pools (hbm, qdma, qsfp) with shared allocation accounting.")
+	flagDeviceAttributes := flag.String("device-attributes", "", "Comma separated list of attributes (serial, shell, timestamp, xclbin_uuid, dbdf, clock_freqs) to attach as container annotations during Allocate.")
+	flag.Uint64Var(&maxTemp, "max-temp", maxTemp, "FPGA temperature in Celsius above which a card is reported unhealthy. 0 disables the check.")
+	flag.Uint64Var(&maxPower, "max-power", maxPower, "Power draw above which a card is reported unhealthy, in the driver's unit. 0 disables the check.")
+	flag.Uint64Var(&minFanSpeed, "min-fan-speed", minFanSpeed, "Fan speed in RPM below which a card is reported unhealthy. 0 disables the check.")
+	flag.StringVar(&deviceKeying, "device-key", deviceKeying, "How cards are keyed into devices: serial groups a card's PFs under its serial number, bdf makes each PF its own device.")
+	flag.StringVar(&degradedPolicy, "degraded-policy", degradedPolicy, "How degraded cards are reported to kubelet: unhealthy withholds them from scheduling, healthy keeps them schedulable at reduced performance.")
+	flagMetricsPort := flag.Int("metrics-port", 0, "Port to serve Prometheus metrics on under /metrics. 0 disables the endpoint.")
+	flagMetricsAddr := flag.String("metrics-addr", "", "Address to serve Prometheus metrics on, e.g. :9101 or 127.0.0.1:9101. Takes precedence over -metrics-port.")
+	flagInspectAddr := flag.String("inspect-addr", "", "Address to serve the read-only device inventory on under /inventory, e.g. 127.0.0.1:9102. Empty disables the endpoint.")
+	flagResourcePrefix := flag.String("resource-prefix", "xilinx.com", "Resource domain advertised devices are registered under.")
+	flagResourceName := flag.String("resource-name", "fpga", "Base resource name; the shell-derived device type is appended to it.")
+	flagVendorIDs := flag.String("vendor-ids", "", "Comma separated hex vendor IDs (e.g. 0x1bb1) recognized in addition to the built-in Xilinx, AWS and Advantech IDs.")
+	flagSysfsRoot := flag.String("sysfs-root", "", "Path where the host /sys is mounted, e.g. /host-sys when containerized. Defaults to the FPGA_SYSFS_ROOT environment variable, then /sys.")
+	flagDevRoot := flag.String("dev-root", "", "Path where the host /dev is mounted. Defaults to the FPGA_DEV_ROOT environment variable, then /dev.")
+	flagUserPrefix := flag.String("user-prefix", "", "Directory holding the DRM render nodes, for udev rules that relocate them. Overrides the /dev/dri default and -dev-root. Defaults to the FPGA_USER_PREFIX environment variable.")
+	flagSubdevPrefix := flag.String("subdev-prefix", "", "Directory holding the xfpga subdevice nodes. Overrides the /dev/xfpga default and -dev-root. Defaults to the FPGA_SUBDEV_PREFIX environment variable.")
+	flagValidate := flag.Bool("validate", false, "Run a preflight validation of the node's FPGA stack, print a report and exit non-zero on any failure.")
+	flagSelfTest := flag.Bool("self-test", false, "Run discovery, probe every device node the plugin would mount for existence and read access, print a pass/fail table and exit.")
+	flagList := flag.Bool("list", false, "Print the devices discovery sees on this node and exit.")
+	flagDump := flag.Bool("dump", false, "Alias for -list -format json.")
+	flagFormat := flag.String("format", "json", "Output format for -list: json or table.")
 	flag.Parse()
 
-	switch *flagLogLevel {
-	case "debug":
+	sysfsRoot := *flagSysfsRoot
+	if sysfsRoot == "" {
+		sysfsRoot = os.Getenv("FPGA_SYSFS_ROOT")
+	}
+	devRoot := *flagDevRoot
+	if devRoot == "" {
+		devRoot = os.Getenv("FPGA_DEV_ROOT")
+	}
+	applyPathPrefixes(sysfsRoot, devRoot)
+	userPrefix := *flagUserPrefix
+	if userPrefix == "" {
+		userPrefix = os.Getenv("FPGA_USER_PREFIX")
+	}
+	subdevPrefix := *flagSubdevPrefix
+	if subdevPrefix == "" {
+		subdevPrefix = os.Getenv("FPGA_SUBDEV_PREFIX")
+	}
+	applyNodePrefixes(userPrefix, subdevPrefix)
+
+	if *flagValidate {
+		os.Exit(runValidation())
+	}
+	if *flagSelfTest {
+		locator = detectSysfsLocator()
+		os.Exit(runSelfTest())
+	}
+	if *flagDump {
+		locator = detectSysfsLocator()
+		os.Exit(runList("json"))
+	}
+	if *flagList {
+		locator = detectSysfsLocator()
+		os.Exit(runList(*flagFormat))
+	}
+
+	if degradedPolicy != "healthy" && degradedPolicy != "unhealthy" {
+		log.Printf("Invalid degraded-policy %q, expect healthy or unhealthy.", degradedPolicy)
+		os.Exit(1)
+	}
+
+	if deviceKeying != deviceKeySerial && deviceKeying != deviceKeyBDF {
+		log.Printf("Invalid device-key %q, expect serial or bdf.", deviceKeying)
+		os.Exit(1)
+	}
+
+	if oversubscribe < 1 {
+		log.Printf("Invalid oversubscribe %d, expect 1 or more.", oversubscribe)
+		os.Exit(1)
+	}
+
+	if healthDebounceScans < 1 {
+		log.Printf("Invalid health-debounce %d, expect 1 or more.", healthDebounceScans)
+		os.Exit(1)
+	}
+
+	if discoveryConcurrency < 1 {
+		log.Printf("Invalid concurrency %d, expect 1 or more.", discoveryConcurrency)
+		os.Exit(1)
+	}
+
+	if bootRetries < 0 {
+		log.Printf("Invalid boot-retries %d, expect 0 or more.", bootRetries)
+		os.Exit(1)
+	}
+
+	prefix, err := composeResourcePrefix(*flagResourcePrefix, *flagResourceName)
+	if err != nil {
+		log.Printf("%s.", err)
+		os.Exit(1)
+	}
+	resourceNamePrefix = prefix
+
+	vendorIDs, err := parseVendorIDs(*flagVendorIDs)
+	if err != nil {
+		log.Printf("%s.", err)
+		os.Exit(1)
+	}
+	extraVendorIDs = vendorIDs
+
+	attrs, err := parseDeviceAttributes(*flagDeviceAttributes)
+	if err != nil {
+		log.Printf("Invalid device-attributes: %s.", err)
+		os.Exit(1)
+	}
+	deviceAttributes = attrs
+
+	bdfList := *flagIncludeBDFs
+	if bdfList == "" {
+		bdfList = os.Getenv("FPGA_INCLUDE_BDFS")
+	}
+	includeBDFs, err = parseBDFList(bdfList)
+	if err != nil {
+		log.Printf("Invalid BDF allowlist: %s.", err)
+		os.Exit(1)
+	}
+
+	for _, pair := range strings.Split(*flagMinTimestamps, ",") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			log.Printf("Ignoring malformed min-timestamp entry %q", pair)
+			continue
+		}
+		ts, err := ParseTimestamp(kv[1])
+		if err != nil {
+			log.Printf("Ignoring min-timestamp entry %q: %s", pair, err)
+			continue
+		}
+		minTimestamps[kv[0]] = ts
+	}
+
+	if *flagAllocConfig != "" {
+		if err := loadAllocExtras(*flagAllocConfig); err != nil {
+			log.Printf("Failed to load alloc config: %s.", err)
+			os.Exit(1)
+		}
+	}
+
+	if *flagExtraDevices != "" {
+		if err := loadExtraDeviceRules(*flagExtraDevices); err != nil {
+			log.Printf("Failed to load extra devices config: %s.", err)
+			os.Exit(1)
+		}
+	}
+
+	for _, pair := range strings.Split(*flagExpectedXclbins, ",") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			log.Printf("Ignoring malformed expected-xclbin entry %q", pair)
+			continue
+		}
+		expectedXclbins[kv[0]] = kv[1]
+	}
+
+	for _, pair := range strings.Split(*flagExpectedShells, ",") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			log.Printf("Ignoring malformed expected-shell entry %q", pair)
+			continue
+		}
+		expectedShells[kv[0]] = kv[1]
+	}
+
+	switch {
+	case *flagVerbosity >= 4:
 		log.SetLevel(log.DebugLevel)
-	case "info":
+	case *flagVerbosity > 0:
+		log.SetLevel(log.InfoLevel)
+	case *flagLogLevel == "debug":
+		log.SetLevel(log.DebugLevel)
+	case *flagLogLevel == "info":
 		log.SetLevel(log.InfoLevel)
 	}
 
+	logFormat := *flagLogFormat
+	if logFormat == "" {
+		logFormat = os.Getenv("LOG_FORMAT")
+	}
+	switch strings.ToLower(logFormat) {
+	case "", "text":
+		// logrus' default text formatter, for interactive use
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		log.Printf("Unknown log format %q, using text.", logFormat)
+	}
+
+	locator = detectSysfsLocator()
+	log.Printf("Using %s sysfs layout.", locator.Name())
+
+	// the first scan gets the boot-time retry so boards still
+	// initializing after node boot are not declared absent
+	if bootRetries > 0 {
+		armBootWindow()
+	}
+
 	log.Println("Starting FS watcher.")
 	watcher, err := newFSWatcher(pluginapi.DevicePluginPath)
 	if err != nil {
@@ -45,14 +328,53 @@ func main() {
 	}
 	defer watcher.Close()
 
+	// watch the config files' directories (not the files themselves, so
+	// atomic renames are seen too) and reload on changes
+	var cfgEvents chan fsnotify.Event
+	var cfgDirs []string
+	seenDirs := make(map[string]bool)
+	for _, fname := range []string{*flagAllocConfig, *flagExtraDevices} {
+		if fname == "" {
+			continue
+		}
+		if dir := filepath.Dir(fname); !seenDirs[dir] {
+			seenDirs[dir] = true
+			cfgDirs = append(cfgDirs, dir)
+		}
+	}
+	if len(cfgDirs) > 0 {
+		cfgWatcher, err := newFSWatcher(cfgDirs...)
+		if err != nil {
+			log.Printf("Failed to watch config files: %s.", err)
+			os.Exit(1)
+		}
+		defer cfgWatcher.Close()
+		cfgEvents = cfgWatcher.Events
+	}
+
 	log.Println("Starting OS watcher.")
 	sigs := newOSWatcher(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
+	otel := newOTelExporter(*flagOTelEndpoint)
+	metricsAddr := *flagMetricsAddr
+	if metricsAddr == "" && *flagMetricsPort != 0 {
+		metricsAddr = fmt.Sprintf(":%d", *flagMetricsPort)
+	}
+	startMetricsServer(metricsAddr)
+	startInspectServer(*flagInspectAddr)
+
 	restart := true
+	warnedExtras := false
 	var devicePlugin *FPGADevicePlugin
 L:
 	for {
 		if restart {
+			// tear the previous generation down first so its sockets are
+			// gone and its ListAndWatch streams are closed before the new
+			// servers register
+			if devicePlugin != nil {
+				devicePlugin.Stop()
+			}
 			devicePlugin = NewFPGADevicePlugin()
 			restart = false
 		}
@@ -60,20 +382,51 @@ L:
 		select {
 		case update := <-devicePlugin.updateChan:
 			devicePlugin.checkDeviceUpdate(update)
+			if !warnedExtras {
+				warnUnknownAllocExtras(devicePlugin.devices)
+				warnedExtras = true
+			}
+			snapshot := takeMetricsSnapshot(devicePlugin.devices)
+			publishMetricsSnapshot(snapshot)
+			publishInventory(devicePlugin.devices)
+			otel.Export(snapshot)
 
 		case event := <-watcher.Events:
-			if event.Name == pluginapi.KubeletSocket && event.Op&fsnotify.Create == fsnotify.Create {
+			switch {
+			case event.Name == pluginapi.KubeletSocket && event.Op&fsnotify.Create == fsnotify.Create:
 				log.Printf("inotify: %s created, restarting.", pluginapi.KubeletSocket)
 				restart = true
+			case event.Name == pluginapi.KubeletSocket && event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+				// a kubelet restart deletes its socket before recreating
+				// it; tear down now and let the registration retries ride
+				// out the gap
+				log.Printf("inotify: %s deleted, restarting.", pluginapi.KubeletSocket)
+				restart = true
+			case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 && devicePlugin.ownsSocket(event.Name):
+				// our own socket was removed under us (kubelet cleanup,
+				// an overzealous operator); without a restart the plugin
+				// goes dark until kubelet gives up on the dead endpoint
+				log.Printf("inotify: %s deleted, re-registering with kubelet.", event.Name)
+				restart = true
 			}
 
 		case err := <-watcher.Errors:
 			log.Printf("inotify: %s", err)
 
+		case event := <-cfgEvents:
+			if (event.Name == *flagAllocConfig || event.Name == *flagExtraDevices) &&
+				event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+				reloadConfig(*flagAllocConfig, *flagExtraDevices, *flagIncludeBDFs)
+			}
+
 		case s := <-sigs:
 			switch s {
 			case syscall.SIGHUP:
-				log.Println("Received SIGHUP, restarting.")
+				// re-read config, then restart: the restart path tears
+				// down the servers and re-registers with kubelet, which
+				// also covers changes that alter resource naming
+				log.Println("Received SIGHUP, reloading config and restarting.")
+				reloadConfig(*flagAllocConfig, *flagExtraDevices, *flagIncludeBDFs)
 				restart = true
 			default:
 				log.Printf("Received signal \"%v\", shutting down.", s)
@@ -81,4 +434,6 @@ L:
 			}
 		}
 	}
+	// leave no stale sockets behind for the next incarnation to trip on
+	devicePlugin.Stop()
 }
@@ -0,0 +1,76 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestApplyPathPrefixes(t *testing.T) {
+	defer func() {
+		SysfsDevices = "/sys/bus/pci/devices"
+		XfpgaClassDir = "/sys/class/xfpga"
+		UserPrefix = "/dev/dri"
+		SubdevPrefix = "/dev/xfpga"
+		awsDevRoot = "/dev"
+		locator = pciLocator{root: SysfsDevices}
+	}()
+
+	applyPathPrefixes("/host-sys", "/host-dev")
+	if SysfsDevices != "/host-sys/bus/pci/devices" {
+		t.Errorf("SysfsDevices = %s", SysfsDevices)
+	}
+	if XfpgaClassDir != "/host-sys/class/xfpga" {
+		t.Errorf("XfpgaClassDir = %s", XfpgaClassDir)
+	}
+	if UserPrefix != "/host-dev/dri" || SubdevPrefix != "/host-dev/xfpga" {
+		t.Errorf("dev prefixes = %s, %s", UserPrefix, SubdevPrefix)
+	}
+	if awsDevRoot != "/host-dev" {
+		t.Errorf("awsDevRoot = %s", awsDevRoot)
+	}
+
+	// empty roots leave the host-absolute defaults untouched
+	SysfsDevices = "/sys/bus/pci/devices"
+	UserPrefix = "/dev/dri"
+	applyPathPrefixes("", "")
+	if SysfsDevices != "/sys/bus/pci/devices" || UserPrefix != "/dev/dri" {
+		t.Errorf("empty roots rewrote paths: %s, %s", SysfsDevices, UserPrefix)
+	}
+}
+
+func TestApplyNodePrefixes(t *testing.T) {
+	defer func() {
+		UserPrefix = "/dev/dri"
+		SubdevPrefix = "/dev/xfpga"
+		awsDevRoot = "/dev"
+	}()
+
+	// an exact prefix wins over the -dev-root rebase
+	applyPathPrefixes("", "/host-dev")
+	applyNodePrefixes("/relocated/dri", "")
+	if UserPrefix != "/relocated/dri" {
+		t.Errorf("UserPrefix = %s", UserPrefix)
+	}
+	if SubdevPrefix != "/host-dev/xfpga" {
+		t.Errorf("SubdevPrefix = %s, want the rebased default kept", SubdevPrefix)
+	}
+
+	applyNodePrefixes("", "/relocated/xfpga")
+	if SubdevPrefix != "/relocated/xfpga" {
+		t.Errorf("SubdevPrefix = %s", SubdevPrefix)
+	}
+}
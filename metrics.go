@@ -0,0 +1,130 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+// Reasons for failed Allocate calls, used as metric labels.
+const (
+	allocFailMissingDevice = "device-missing"
+	allocFailPoolConflict  = "pool-conflict"
+)
+
+// allocFailures counts failed Allocate calls by reason, and per device
+// so repeated failures on one card stand out.
+var allocFailures = struct {
+	sync.Mutex
+	byReason map[string]uint64
+	byDevice map[string]uint64
+}{
+	byReason: make(map[string]uint64),
+	byDevice: make(map[string]uint64),
+}
+
+// countAllocFailure records a failed Allocate call. A card failing
+// repeatedly is reported loudly: it looks healthy to the scheduler but
+// cannot actually be handed to pods.
+func countAllocFailure(reason, device string) {
+	allocFailures.Lock()
+	defer allocFailures.Unlock()
+	allocFailures.byReason[reason]++
+	allocFailures.byDevice[device]++
+	if count := allocFailures.byDevice[device]; count > 1 && count%3 == 0 {
+		log.WithFields(log.Fields{
+			"device": device,
+			"count":  count,
+			"reason": reason,
+		}).Warn("Device keeps failing allocation")
+	}
+}
+
+// allocFailureCounts returns a copy of the per-reason counters.
+func allocFailureCounts() map[string]uint64 {
+	allocFailures.Lock()
+	defer allocFailures.Unlock()
+	counts := make(map[string]uint64, len(allocFailures.byReason))
+	for reason, count := range allocFailures.byReason {
+		counts[reason] = count
+	}
+	return counts
+}
+
+// deviceMetric holds the metric values derived from a single Device.
+type deviceMetric struct {
+	sn             string
+	shellVer       string
+	resource       string
+	xclbinUUID     string
+	recoveryAction string
+	powerProfile   string
+	healthy        bool
+	shellMismatch  bool
+	temp           uint64
+	// dbdf is the card's (first) PCI address, identifying the board in
+	// telemetry series alongside the serial
+	dbdf      string
+	telemetry DeviceTelemetry
+}
+
+// metricsSnapshot is a point-in-time view of the device inventory used
+// by the metric exporters. All exporters share this computation so the
+// values they report are always consistent with each other.
+type metricsSnapshot struct {
+	taken         time.Time
+	devices       []deviceMetric
+	allocFailures map[string]uint64
+}
+
+// takeMetricsSnapshot derives a metricsSnapshot from the plugin's
+// current device map, keyed by DSA type then serial number.
+func takeMetricsSnapshot(devices map[string]map[string]Device) *metricsSnapshot {
+	snapshot := &metricsSnapshot{
+		taken:         time.Now(),
+		allocFailures: allocFailureCounts(),
+	}
+	for dsaType, subMap := range devices {
+		for sn, device := range subMap {
+			dbdf := ""
+			if len(device.Nodes) > 0 {
+				dbdf = device.Nodes[0].DBDF
+			}
+			var tele DeviceTelemetry
+			if dbdf != "" {
+				tele = GetTelemetry(dbdf)
+			}
+			snapshot.devices = append(snapshot.devices, deviceMetric{
+				sn:             sn,
+				shellVer:       device.shellVer,
+				resource:       resourceNamePrefix + "-" + dsaType,
+				xclbinUUID:     device.xclbinUUID,
+				recoveryAction: device.recoveryAction,
+				powerProfile:   device.powerProfile,
+				healthy:        device.Healthy == pluginapi.Healthy,
+				shellMismatch:  device.shellMismatch,
+				temp:           device.temp,
+				dbdf:           dbdf,
+				telemetry:      tele,
+			})
+		}
+	}
+	return snapshot
+}
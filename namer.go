@@ -0,0 +1,93 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// composeResourcePrefix joins the operator supplied resource domain and
+// base name (e.g. xilinx.com and fpga) into the prefix all advertised
+// resources share, validating it against Kubernetes' qualified-name
+// rules so a bad flag fails at startup instead of at registration.
+func composeResourcePrefix(domain, base string) (string, error) {
+	full := domain + "/" + base
+	if errs := validation.IsQualifiedName(full); len(errs) != 0 {
+		return "", fmt.Errorf("invalid resource name %s: %s", full, strings.Join(errs, "; "))
+	}
+	return full, nil
+}
+
+// resourceNameOf derives the resource name suffix (the "device type")
+// a card is advertised under from its shell VBNV, DSA timestamp and
+// node count. Operators with mixed fleets request e.g.
+// xilinx.com/fpga-xilinx_u250_gen3x16_xdma_3_1-1561465320-1 rather
+// than a generic pool, and the plugin registers one device-plugin
+// socket per distinct name.
+//
+// Normalization follows sanitizeResourceName: dots and underscores are
+// legal mid-name and kept, slashes and colons become '-', and case is
+// preserved since Kubernetes resource names are case sensitive. Any
+// altered or overlong name gets a hash suffix to stay unique.
+func resourceNameOf(device Device) string {
+	return sanitizeResourceName(device.shellVer + "-" + device.timestamp +
+		"-" + strconv.Itoa(len(device.Nodes)))
+}
+
+// The name part of an extended resource is limited to 63 characters;
+// the plugin prepends "fpga-" to the device type.
+const maxDevTypeLen = 63 - len("fpga-")
+
+// sanitizeResourceName converts a device type string (derived from the
+// shell VBNV and timestamp) into a string valid as part of a Kubernetes
+// resource name: alphanumerics plus '-', '_' and '.', starting and
+// ending alphanumeric, within the length limit.
+//
+// Characters outside that set (colons, slashes, spaces) become '-'.
+// Whenever sanitization alters the input, or the input is too long, a
+// short hash of the original is appended so distinct shell versions
+// never map to the same resource name.
+func sanitizeResourceName(devType string) string {
+	mapped := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '_', r == '.':
+			return r
+		}
+		return '-'
+	}, devType)
+	mapped = strings.Trim(mapped, "-_.")
+	if mapped == devType && len(mapped) <= maxDevTypeLen {
+		return mapped
+	}
+	h := fnv.New32a()
+	h.Write([]byte(devType))
+	suffix := fmt.Sprintf("-%08x", h.Sum32())
+	if len(mapped)+len(suffix) > maxDevTypeLen {
+		mapped = mapped[:maxDevTypeLen-len(suffix)]
+	}
+	mapped = strings.TrimRight(mapped, "-_.")
+	if mapped == "" {
+		mapped = "fpga"
+	}
+	return mapped + suffix
+}
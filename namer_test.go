@@ -0,0 +1,121 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// A corpus of real and known-tricky VBNV/device type strings: plain
+// shells, dots, colons, mixed case, leading/trailing separators, and
+// over-length values.
+var namerCorpus = []string{
+	"xilinx_u250_xdma_201830_2-1561465320-1",
+	"xilinx_u200_xdma_201830_1-1535712995-1",
+	"xilinx_u250_gen3x16_xdma_3_1_202020_1-1608854735-2",
+	"xilinx_u50_gen3x16_xdma_201920_3-0x5e278820-1",
+	"xilinx_vcu1525_dynamic_5.1-1521396441-1",
+	"Xilinx_U250_QEP.Gen3x16-1561465320-1",
+	"xilinx:u280:xdma:201920.3-12345-1",
+	"aws-vu9p-f1:dynamic:5.0-0-1",
+	"shell with spaces-0-1",
+	"xilinx_u250_gen3x16_base_4_some_very_long_platform_name_that_overflows_the_limit-1608854735-8",
+	"-leading-and-trailing.-0-1-",
+	"日本語-shell-0-1",
+}
+
+func TestComposeResourcePrefix(t *testing.T) {
+	prefix, err := composeResourcePrefix("xilinx.com", "fpga")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefix != "xilinx.com/fpga" {
+		t.Errorf("prefix = %q", prefix)
+	}
+
+	// other vendors and test domains are the point of the flags
+	if _, err := composeResourcePrefix("acme.example.org", "accelerator"); err != nil {
+		t.Errorf("valid custom prefix rejected: %v", err)
+	}
+
+	for _, c := range []struct{ domain, base string }{
+		{"xilinx.com", "fpga/extra"}, // slash in the base adds a segment
+		{"", "fpga"},                 // empty domain
+		{"xilinx.com", ""},           // empty base
+		{"xilinx.com", "-fpga"},      // must start alphanumeric
+		{"UPPER_CASE", "fpga"},       // domains are lower-case DNS names
+	} {
+		if _, err := composeResourcePrefix(c.domain, c.base); err == nil {
+			t.Errorf("%s/%s accepted, want error", c.domain, c.base)
+		}
+	}
+}
+
+func TestSanitizeResourceNameValid(t *testing.T) {
+	for _, devType := range namerCorpus {
+		name := sanitizeResourceName(devType)
+		resource := resourceNamePrefix + "-" + name
+		if errs := validation.IsQualifiedName(resource); len(errs) != 0 {
+			t.Errorf("sanitizeResourceName(%q) = %q: invalid resource %q: %v",
+				devType, name, resource, errs)
+		}
+	}
+}
+
+func TestSanitizeResourceNameNoCollisions(t *testing.T) {
+	seen := make(map[string]string)
+	for _, devType := range namerCorpus {
+		name := sanitizeResourceName(devType)
+		if prev, ok := seen[name]; ok {
+			t.Errorf("collision: %q and %q both map to %q", prev, devType, name)
+		}
+		seen[name] = devType
+	}
+}
+
+func TestSanitizeResourceNameStable(t *testing.T) {
+	for _, devType := range namerCorpus {
+		if sanitizeResourceName(devType) != sanitizeResourceName(devType) {
+			t.Errorf("sanitizeResourceName(%q) is not deterministic", devType)
+		}
+	}
+}
+
+func TestSanitizeResourceNameKeepsCleanInput(t *testing.T) {
+	in := "xilinx_u250_xdma_201830_2-1561465320-1"
+	if out := sanitizeResourceName(in); out != in {
+		t.Errorf("clean input %q was altered to %q", in, out)
+	}
+}
+
+func TestResourceNameOf(t *testing.T) {
+	device := Device{
+		shellVer:  "xilinx_u250_gen3x16_xdma_3_1",
+		timestamp: "1561465320",
+		Nodes:     []Node{{}},
+	}
+	if got := resourceNameOf(device); got != "xilinx_u250_gen3x16_xdma_3_1-1561465320-1" {
+		t.Errorf("resourceNameOf = %q", got)
+	}
+	// illegal characters in the VBNV are normalized, not passed through
+	device.shellVer = "vendor/shell:v2"
+	got := resourceNameOf(device)
+	for _, errs := range validation.IsQualifiedName(resourceNamePrefix + "-" + got) {
+		t.Errorf("resourceNameOf(%q) = %q: %s", device.shellVer, got, errs)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// otelExporter pushes device metrics to an OTLP/HTTP endpoint in JSON
+// encoding. It is kept dependency-free on purpose: the plugin only needs
+// a couple of gauges, so the OTLP request is built by hand from the
+// shared metricsSnapshot instead of pulling in the OTel SDK.
+//
+// Every metric carries the resource attributes "host.name" (the node)
+// and, per data point, "serial" identifying the card.
+type otelExporter struct {
+	endpoint string
+	node     string
+	client   *http.Client
+}
+
+// newOTelExporter returns an exporter posting to endpoint, e.g.
+// http://collector:4318/v1/metrics. An empty endpoint disables export.
+func newOTelExporter(endpoint string) *otelExporter {
+	if endpoint == "" {
+		return nil
+	}
+	node, _ := os.Hostname()
+	return &otelExporter{
+		endpoint: endpoint,
+		node:     node,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type otelAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otelDataPoint struct {
+	Attributes   []otelAttribute `json:"attributes,omitempty"`
+	TimeUnixNano int64           `json:"timeUnixNano,string"`
+	AsInt        int64           `json:"asInt,string"`
+}
+
+type otelMetric struct {
+	Name  string `json:"name"`
+	Gauge struct {
+		DataPoints []otelDataPoint `json:"dataPoints"`
+	} `json:"gauge"`
+}
+
+func otelStringAttribute(key, value string) otelAttribute {
+	attr := otelAttribute{Key: key}
+	attr.Value.StringValue = value
+	return attr
+}
+
+// Export posts the snapshot to the collector. Failures are logged but do
+// not affect the plugin; metrics export is strictly best effort.
+func (e *otelExporter) Export(snapshot *metricsSnapshot) {
+	if e == nil {
+		return
+	}
+	ts := snapshot.taken.UnixNano()
+
+	total := otelMetric{Name: "fpga.devices.total"}
+	total.Gauge.DataPoints = []otelDataPoint{{
+		TimeUnixNano: ts,
+		AsInt:        int64(len(snapshot.devices)),
+	}}
+
+	health := otelMetric{Name: "fpga.device.healthy"}
+	for _, dm := range snapshot.devices {
+		attrs := []otelAttribute{
+			otelStringAttribute("serial", dm.sn),
+			otelStringAttribute("shell", dm.shellVer),
+		}
+		if dm.xclbinUUID != "" {
+			attrs = append(attrs, otelStringAttribute("xclbin_uuid", dm.xclbinUUID))
+		}
+		if dm.powerProfile != "" {
+			attrs = append(attrs, otelStringAttribute("power_profile", dm.powerProfile))
+		}
+		// operators only care about the recovery action for cards that
+		// are not healthy
+		if !dm.healthy && dm.recoveryAction != "" {
+			attrs = append(attrs, otelStringAttribute("recovery_action", dm.recoveryAction))
+		}
+		point := otelDataPoint{
+			Attributes:   attrs,
+			TimeUnixNano: ts,
+		}
+		if dm.healthy {
+			point.AsInt = 1
+		}
+		health.Gauge.DataPoints = append(health.Gauge.DataPoints, point)
+	}
+
+	failures := otelMetric{Name: "fpga.allocate.failures"}
+	for reason, count := range snapshot.allocFailures {
+		failures.Gauge.DataPoints = append(failures.Gauge.DataPoints, otelDataPoint{
+			Attributes:   []otelAttribute{otelStringAttribute("reason", reason)},
+			TimeUnixNano: ts,
+			AsInt:        int64(count),
+		})
+	}
+
+	body := map[string]interface{}{
+		"resourceMetrics": []map[string]interface{}{{
+			"resource": map[string]interface{}{
+				"attributes": []otelAttribute{
+					otelStringAttribute("host.name", e.node),
+					otelStringAttribute("service.name", "xilinx-fpga-device-plugin"),
+				},
+			},
+			"scopeMetrics": []map[string]interface{}{{
+				"metrics": []otelMetric{total, health, failures},
+			}},
+		}},
+	}
+
+	buf, err := json.Marshal(body)
+	if err != nil {
+		log.Errorf("Can't marshal OTLP request: %v", err)
+		return
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		log.Warnf("Can't export metrics to %s: %v", e.endpoint, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Warnf("OTLP export to %s failed: %s", e.endpoint, resp.Status)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// otlpPayload mirrors the envelope Export builds, for decoding what
+// arrived at the collector.
+type otlpPayload struct {
+	ResourceMetrics []struct {
+		Resource struct {
+			Attributes []otelAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeMetrics []struct {
+			Metrics []otelMetric `json:"metrics"`
+		} `json:"scopeMetrics"`
+	} `json:"resourceMetrics"`
+}
+
+func attrValue(attrs []otelAttribute, key string) (string, bool) {
+	for _, attr := range attrs {
+		if attr.Key == key {
+			return attr.Value.StringValue, true
+		}
+	}
+	return "", false
+}
+
+func TestOTelExport(t *testing.T) {
+	var raw []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("content type = %q", ct)
+		}
+		raw, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	snapshot := &metricsSnapshot{
+		taken: time.Unix(1600000000, 0),
+		devices: []deviceMetric{
+			{sn: "serialA", shellVer: "xilinx_u250_xdma_201830_2", healthy: true,
+				xclbinUUID: "uuid-a", powerProfile: "75W"},
+			{sn: "serialB", shellVer: "xilinx_u50_gen3x16_xdma_201920_3", healthy: false,
+				recoveryAction: RecoveryHotReset},
+		},
+		allocFailures: map[string]uint64{allocFailMissingDevice: 2},
+	}
+	exporter := newOTelExporter(server.URL)
+	exporter.Export(snapshot)
+
+	// OTLP/JSON carries int64 values as strings
+	for _, want := range []string{`"timeUnixNano":"`, `"asInt":"`} {
+		if !strings.Contains(string(raw), want) {
+			t.Errorf("request body missing %s encoding:\n%s", want, raw)
+		}
+	}
+
+	var payload otlpPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		t.Fatalf("collector got undecodable body: %v\n%s", err, raw)
+	}
+	if len(payload.ResourceMetrics) != 1 || len(payload.ResourceMetrics[0].ScopeMetrics) != 1 {
+		t.Fatalf("unexpected envelope shape:\n%s", raw)
+	}
+	if got, _ := attrValue(payload.ResourceMetrics[0].Resource.Attributes, "service.name"); got != "xilinx-fpga-device-plugin" {
+		t.Errorf("service.name = %q", got)
+	}
+	if _, ok := attrValue(payload.ResourceMetrics[0].Resource.Attributes, "host.name"); !ok {
+		t.Error("host.name resource attribute missing")
+	}
+
+	metrics := make(map[string]otelMetric)
+	for _, metric := range payload.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		metrics[metric.Name] = metric
+	}
+
+	total, ok := metrics["fpga.devices.total"]
+	if !ok || len(total.Gauge.DataPoints) != 1 {
+		t.Fatalf("fpga.devices.total = %+v", total)
+	}
+	if total.Gauge.DataPoints[0].AsInt != 2 {
+		t.Errorf("device total = %d, want 2", total.Gauge.DataPoints[0].AsInt)
+	}
+	if total.Gauge.DataPoints[0].TimeUnixNano != snapshot.taken.UnixNano() {
+		t.Errorf("timestamp = %d", total.Gauge.DataPoints[0].TimeUnixNano)
+	}
+
+	health, ok := metrics["fpga.device.healthy"]
+	if !ok || len(health.Gauge.DataPoints) != 2 {
+		t.Fatalf("fpga.device.healthy = %+v", health)
+	}
+	for _, point := range health.Gauge.DataPoints {
+		serial, _ := attrValue(point.Attributes, "serial")
+		switch serial {
+		case "serialA":
+			if point.AsInt != 1 {
+				t.Errorf("healthy card reported %d", point.AsInt)
+			}
+			if got, _ := attrValue(point.Attributes, "xclbin_uuid"); got != "uuid-a" {
+				t.Errorf("xclbin_uuid = %q", got)
+			}
+			if got, _ := attrValue(point.Attributes, "power_profile"); got != "75W" {
+				t.Errorf("power_profile = %q", got)
+			}
+			// recovery action is only attached to unhealthy cards
+			if _, ok := attrValue(point.Attributes, "recovery_action"); ok {
+				t.Error("healthy card carries a recovery_action attribute")
+			}
+		case "serialB":
+			if point.AsInt != 0 {
+				t.Errorf("unhealthy card reported %d", point.AsInt)
+			}
+			if got, _ := attrValue(point.Attributes, "recovery_action"); got != RecoveryHotReset {
+				t.Errorf("recovery_action = %q", got)
+			}
+		default:
+			t.Errorf("unexpected serial %q", serial)
+		}
+	}
+
+	failures, ok := metrics["fpga.allocate.failures"]
+	if !ok || len(failures.Gauge.DataPoints) != 1 {
+		t.Fatalf("fpga.allocate.failures = %+v", failures)
+	}
+	if got, _ := attrValue(failures.Gauge.DataPoints[0].Attributes, "reason"); got != allocFailMissingDevice {
+		t.Errorf("failure reason = %q", got)
+	}
+	if failures.Gauge.DataPoints[0].AsInt != 2 {
+		t.Errorf("failure count = %d", failures.Gauge.DataPoints[0].AsInt)
+	}
+}
+
+func TestOTelExportBestEffort(t *testing.T) {
+	// an empty endpoint disables export entirely
+	if exporter := newOTelExporter(""); exporter != nil {
+		t.Errorf("empty endpoint built an exporter: %+v", exporter)
+	}
+	snapshot := &metricsSnapshot{taken: time.Now()}
+
+	// Export on the disabled (nil) exporter is a no-op, not a panic
+	var disabled *otelExporter
+	disabled.Export(snapshot)
+
+	// a rejecting collector is logged and otherwise ignored
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "over quota", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	newOTelExporter(server.URL).Export(snapshot)
+	if requests != 1 {
+		t.Errorf("expected one export attempt, got %d", requests)
+	}
+
+	// an unreachable collector is equally non-fatal
+	server.Close()
+	newOTelExporter(server.URL).Export(snapshot)
+}
@@ -0,0 +1,213 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// promState holds the latest metrics snapshot served on /metrics. The
+// snapshot is replaced wholesale on every discovery cycle, so series
+// for devices that disappeared are dropped instead of lingering.
+var promState = struct {
+	sync.Mutex
+	snapshot *metricsSnapshot
+}{}
+
+// publishMetricsSnapshot makes the snapshot the one served on /metrics.
+func publishMetricsSnapshot(snapshot *metricsSnapshot) {
+	promState.Lock()
+	promState.snapshot = snapshot
+	promState.Unlock()
+}
+
+// discoveryBuckets are the histogram bucket bounds for discovery
+// latency, in seconds. Sysfs walks are fast, so the buckets concentrate
+// on the sub-second range.
+var discoveryBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// discoveryHist accumulates GetDevices durations for the
+// fpga_discovery_duration_seconds histogram.
+var discoveryHist = struct {
+	sync.Mutex
+	counts []uint64 // per-bucket, non-cumulative
+	sum    float64
+	count  uint64
+}{counts: make([]uint64, len(discoveryBuckets)+1)}
+
+// observeDiscoveryDuration records one GetDevices duration.
+func observeDiscoveryDuration(d time.Duration) {
+	seconds := d.Seconds()
+	bucket := len(discoveryBuckets) // the +Inf bucket
+	for i, le := range discoveryBuckets {
+		if seconds <= le {
+			bucket = i
+			break
+		}
+	}
+	discoveryHist.Lock()
+	discoveryHist.counts[bucket]++
+	discoveryHist.sum += seconds
+	discoveryHist.count++
+	discoveryHist.Unlock()
+}
+
+// promEscape escapes a label value per the text exposition format.
+func promEscape(val string) string {
+	val = strings.Replace(val, `\`, `\\`, -1)
+	val = strings.Replace(val, "\n", `\n`, -1)
+	return strings.Replace(val, `"`, `\"`, -1)
+}
+
+// writePromMetrics renders the snapshot in the Prometheus text
+// exposition format. The plugin needs a handful of gauges, so the
+// format is emitted by hand rather than pulling in a client library.
+func writePromMetrics(w io.Writer, snapshot *metricsSnapshot) {
+	fmt.Fprint(w, "# HELP fpga_devices_total Number of FPGA devices discovered on this node, by shell and resource.\n")
+	fmt.Fprint(w, "# TYPE fpga_devices_total gauge\n")
+	counts := make(map[[2]string]int)
+	unhealthy := 0
+	for _, dm := range snapshot.devices {
+		counts[[2]string{dm.shellVer, dm.resource}]++
+		if !dm.healthy {
+			unhealthy++
+		}
+	}
+	for key, count := range counts {
+		fmt.Fprintf(w, "fpga_devices_total{shell=%q,resource=%q} %d\n",
+			promEscape(key[0]), promEscape(key[1]), count)
+	}
+
+	fmt.Fprint(w, "# HELP fpga_devices_unhealthy_total Number of discovered FPGA devices currently reported unhealthy.\n")
+	fmt.Fprint(w, "# TYPE fpga_devices_unhealthy_total gauge\n")
+	fmt.Fprintf(w, "fpga_devices_unhealthy_total %d\n", unhealthy)
+
+	fmt.Fprint(w, "# HELP fpga_device_healthy Whether the device is reported healthy (1) or not (0).\n")
+	fmt.Fprint(w, "# TYPE fpga_device_healthy gauge\n")
+	for _, dm := range snapshot.devices {
+		val := 0
+		if dm.healthy {
+			val = 1
+		}
+		fmt.Fprintf(w, "fpga_device_healthy{serial=%q,shell=%q} %d\n",
+			promEscape(dm.sn), promEscape(dm.shellVer), val)
+	}
+
+	fmt.Fprint(w, "# HELP fpga_device_shell_mismatch Whether the device runs a different shell than the expected golden VBNV (1) or not (0).\n")
+	fmt.Fprint(w, "# TYPE fpga_device_shell_mismatch gauge\n")
+	for _, dm := range snapshot.devices {
+		val := 0
+		if dm.shellMismatch {
+			val = 1
+		}
+		fmt.Fprintf(w, "fpga_device_shell_mismatch{serial=%q,shell=%q} %d\n",
+			promEscape(dm.sn), promEscape(dm.shellVer), val)
+	}
+
+	fmt.Fprint(w, "# HELP fpga_device_temp_celsius FPGA die temperature, 0 when the board does not report one.\n")
+	fmt.Fprint(w, "# TYPE fpga_device_temp_celsius gauge\n")
+	for _, dm := range snapshot.devices {
+		fmt.Fprintf(w, "fpga_device_temp_celsius{serial=%q} %d\n",
+			promEscape(dm.sn), dm.temp)
+	}
+
+	// the telemetry gauges are emitted per sensor the board actually
+	// exposes; older shells without a sensor simply have no series,
+	// instead of a misleading zero
+	fmt.Fprint(w, "# HELP fpga_device_temperature_celsius FPGA die temperature from the XMC sensor.\n")
+	fmt.Fprint(w, "# TYPE fpga_device_temperature_celsius gauge\n")
+	for _, dm := range snapshot.devices {
+		if dm.telemetry.TempValid {
+			fmt.Fprintf(w, "fpga_device_temperature_celsius{serial=%q,bdf=%q} %d\n",
+				promEscape(dm.sn), promEscape(dm.dbdf), dm.telemetry.Temp)
+		}
+	}
+
+	fmt.Fprint(w, "# HELP fpga_device_power Board power draw, in the driver's reported unit (microwatts on current XRT).\n")
+	fmt.Fprint(w, "# TYPE fpga_device_power gauge\n")
+	for _, dm := range snapshot.devices {
+		if dm.telemetry.PowerValid {
+			fmt.Fprintf(w, "fpga_device_power{serial=%q,bdf=%q} %d\n",
+				promEscape(dm.sn), promEscape(dm.dbdf), dm.telemetry.Power)
+		}
+	}
+
+	fmt.Fprint(w, "# HELP fpga_device_fan_rpm Fan speed reported by the XMC.\n")
+	fmt.Fprint(w, "# TYPE fpga_device_fan_rpm gauge\n")
+	for _, dm := range snapshot.devices {
+		if dm.telemetry.FanValid {
+			fmt.Fprintf(w, "fpga_device_fan_rpm{serial=%q,bdf=%q} %d\n",
+				promEscape(dm.sn), promEscape(dm.dbdf), dm.telemetry.FanRPM)
+		}
+	}
+
+	fmt.Fprint(w, "# HELP fpga_allocate_failures_total Failed Allocate calls by reason.\n")
+	fmt.Fprint(w, "# TYPE fpga_allocate_failures_total counter\n")
+	for reason, count := range snapshot.allocFailures {
+		fmt.Fprintf(w, "fpga_allocate_failures_total{reason=%q} %d\n",
+			promEscape(reason), count)
+	}
+
+	fmt.Fprint(w, "# HELP fpga_discovery_duration_seconds Time spent in one device discovery pass.\n")
+	fmt.Fprint(w, "# TYPE fpga_discovery_duration_seconds histogram\n")
+	discoveryHist.Lock()
+	cumulative := uint64(0)
+	for i, le := range discoveryBuckets {
+		cumulative += discoveryHist.counts[i]
+		fmt.Fprintf(w, "fpga_discovery_duration_seconds_bucket{le=%q} %d\n",
+			strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "fpga_discovery_duration_seconds_bucket{le=\"+Inf\"} %d\n", discoveryHist.count)
+	fmt.Fprintf(w, "fpga_discovery_duration_seconds_sum %g\n", discoveryHist.sum)
+	fmt.Fprintf(w, "fpga_discovery_duration_seconds_count %d\n", discoveryHist.count)
+	discoveryHist.Unlock()
+}
+
+func promHandler(w http.ResponseWriter, r *http.Request) {
+	promState.Lock()
+	snapshot := promState.snapshot
+	promState.Unlock()
+	if snapshot == nil {
+		// no scan has completed yet
+		snapshot = &metricsSnapshot{}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writePromMetrics(w, snapshot)
+}
+
+// startMetricsServer serves Prometheus metrics on addr, e.g. ":9101".
+// An empty addr disables the endpoint.
+func startMetricsServer(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", promHandler)
+	go func() {
+		log.Printf("Serving metrics on %s/metrics", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Errorf("Metrics listener failed: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,107 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWritePromMetrics(t *testing.T) {
+	snapshot := &metricsSnapshot{
+		taken: time.Now(),
+		devices: []deviceMetric{
+			{sn: "serialA", shellVer: "xilinx_u250_xdma_201830_2", resource: "xilinx.com/fpga-a", healthy: true, temp: 61,
+				dbdf: "0000:65:00.1",
+				telemetry: DeviceTelemetry{Temp: 61, TempValid: true,
+					Power: 75000000, PowerValid: true, FanRPM: 1450, FanValid: true}},
+			// serialB's older shell exposes no sensors: no telemetry series
+			{sn: "serialB", shellVer: "xilinx_u50_gen3x16_xdma_201920_3", resource: "xilinx.com/fpga-b", healthy: false, temp: 97,
+				dbdf: "0000:81:00.1"},
+		},
+		allocFailures: map[string]uint64{allocFailMissingDevice: 2},
+	}
+	// other tests trigger discovery too; start the histogram fresh
+	discoveryHist.Lock()
+	discoveryHist.counts = make([]uint64, len(discoveryBuckets)+1)
+	discoveryHist.sum = 0
+	discoveryHist.count = 0
+	discoveryHist.Unlock()
+	observeDiscoveryDuration(7 * time.Millisecond)
+
+	var buf bytes.Buffer
+	writePromMetrics(&buf, snapshot)
+	out := buf.String()
+
+	for _, want := range []string{
+		`fpga_devices_total{shell="xilinx_u250_xdma_201830_2",resource="xilinx.com/fpga-a"} 1`,
+		`fpga_devices_total{shell="xilinx_u50_gen3x16_xdma_201920_3",resource="xilinx.com/fpga-b"} 1`,
+		"fpga_devices_unhealthy_total 1\n",
+		`fpga_discovery_duration_seconds_bucket{le="0.01"} 1`,
+		"fpga_discovery_duration_seconds_count 1\n",
+		`fpga_device_healthy{serial="serialA",shell="xilinx_u250_xdma_201830_2"} 1`,
+		`fpga_device_healthy{serial="serialB",shell="xilinx_u50_gen3x16_xdma_201920_3"} 0`,
+		`fpga_device_temp_celsius{serial="serialB"} 97`,
+		`fpga_allocate_failures_total{reason="device-missing"} 2`,
+		`fpga_device_temperature_celsius{serial="serialA",bdf="0000:65:00.1"} 61`,
+		`fpga_device_power{serial="serialA",bdf="0000:65:00.1"} 75000000`,
+		`fpga_device_fan_rpm{serial="serialA",bdf="0000:65:00.1"} 1450`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics output missing %q:\n%s", want, out)
+		}
+	}
+	// a board without sensors contributes no telemetry series at all
+	for _, absent := range []string{
+		`fpga_device_temperature_celsius{serial="serialB"`,
+		`fpga_device_power{serial="serialB"`,
+		`fpga_device_fan_rpm{serial="serialB"`,
+	} {
+		if strings.Contains(out, absent) {
+			t.Errorf("metrics output has series %q for a sensorless board:\n%s", absent, out)
+		}
+	}
+}
+
+func TestPromHandlerDropsStaleSeries(t *testing.T) {
+	defer publishMetricsSnapshot(nil)
+
+	publishMetricsSnapshot(&metricsSnapshot{
+		devices: []deviceMetric{{sn: "serialA", healthy: true}},
+	})
+	rec := httptest.NewRecorder()
+	promHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "serialA") {
+		t.Fatalf("serialA missing from metrics:\n%s", rec.Body.String())
+	}
+
+	// the device disappeared; its series must not linger
+	publishMetricsSnapshot(&metricsSnapshot{})
+	rec = httptest.NewRecorder()
+	promHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(rec.Body.String(), "serialA") {
+		t.Errorf("stale series survived the device's removal:\n%s", rec.Body.String())
+	}
+}
+
+func TestPromEscape(t *testing.T) {
+	if got := promEscape(`a"b\c`); got != `a\"b\\c` {
+		t.Errorf("promEscape = %q", got)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// readCache memoizes sysfs reads, keyed by absolute path, for the
+// duration of one device scan. GetDevices arms it on entry and drops
+// it on return: within a scan the same device directory is listed
+// several times (rom, xmc and qdma lookups all re-read it), but no
+// cached state may survive into the next scan since device state
+// changes. Only successful reads are cached; failures are cheap and
+// always hit the filesystem. Public return values are unchanged.
+var readCache = struct {
+	sync.Mutex
+	active bool
+	dirs   map[string][]os.FileInfo
+	files  map[string]string
+}{}
+
+// beginScanCache arms the cache for one scan and returns the func that
+// disarms and clears it.
+func beginScanCache() func() {
+	readCache.Lock()
+	readCache.active = true
+	readCache.dirs = make(map[string][]os.FileInfo)
+	readCache.files = make(map[string]string)
+	readCache.Unlock()
+	return func() {
+		readCache.Lock()
+		readCache.active = false
+		readCache.dirs = nil
+		readCache.files = nil
+		readCache.Unlock()
+	}
+}
+
+// forgetCachedFile drops one file from the active scan cache so the
+// next read hits sysfs again, for callers that re-poll an attribute
+// mid-scan (the boot-window ready retry).
+func forgetCachedFile(file string) {
+	readCache.Lock()
+	if readCache.active {
+		delete(readCache.files, file)
+	}
+	readCache.Unlock()
+}
+
+// cachedReadDir is ioutil.ReadDir behind the scan cache.
+func cachedReadDir(dir string) ([]os.FileInfo, error) {
+	readCache.Lock()
+	if readCache.active {
+		if files, ok := readCache.dirs[dir]; ok {
+			readCache.Unlock()
+			return files, nil
+		}
+	}
+	readCache.Unlock()
+	files, err := fsys.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	readCache.Lock()
+	if readCache.active {
+		readCache.dirs[dir] = files
+	}
+	readCache.Unlock()
+	return files, nil
+}
+
+// cachedReadFile is ioutil.ReadFile behind the scan cache.
+func cachedReadFile(file string) (string, error) {
+	readCache.Lock()
+	if readCache.active {
+		if content, ok := readCache.files[file]; ok {
+			readCache.Unlock()
+			return content, nil
+		}
+	}
+	readCache.Unlock()
+	buf, err := fsys.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	content := string(buf)
+	readCache.Lock()
+	if readCache.active {
+		readCache.files[file] = content
+	}
+	readCache.Unlock()
+	return content, nil
+}
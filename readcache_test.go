@@ -0,0 +1,69 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestScanCacheMemoizesWithinScan(t *testing.T) {
+	dir := t.TempDir()
+	fname := path.Join(dir, "serial_num")
+	if err := ioutil.WriteFile(fname, []byte("serialA\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	end := beginScanCache()
+	if got, _ := GetFileContent(fname); got != "serialA" {
+		t.Fatalf("first read = %q, want serialA", got)
+	}
+	// a change mid-scan is not observed: the scan sees one consistent
+	// snapshot
+	if err := ioutil.WriteFile(fname, []byte("serialB\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := GetFileContent(fname); got != "serialA" {
+		t.Errorf("read within scan = %q, want cached serialA", got)
+	}
+	if name, _ := GetFileNameFromPrefix(dir, "serial"); name != "serial_num" {
+		t.Errorf("GetFileNameFromPrefix = %q, want serial_num", name)
+	}
+	end()
+
+	// nothing persists across scans
+	if got, _ := GetFileContent(fname); got != "serialB" {
+		t.Errorf("read after scan = %q, want fresh serialB", got)
+	}
+}
+
+func TestScanCacheInactiveByDefault(t *testing.T) {
+	dir := t.TempDir()
+	fname := path.Join(dir, "ready")
+	if err := ioutil.WriteFile(fname, []byte("0x0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := GetFileContent(fname); got != "0x0" {
+		t.Fatalf("read = %q, want 0x0", got)
+	}
+	if err := ioutil.WriteFile(fname, []byte("0x1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := GetFileContent(fname); got != "0x1" {
+		t.Errorf("read outside a scan = %q, want uncached 0x1", got)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+)
+
+// scanFunc performs the actual sysfs walk. It is a variable so tests
+// can substitute a slow fake and observe the singleflight behavior.
+var scanFunc = GetDevicesCached
+
+// scanGroup serializes device scans. Only one scan walks sysfs at a
+// time; callers arriving while one is in progress join it and share
+// its result instead of doing the heavy work again.
+var scanGroup struct {
+	sync.Mutex
+	inflight bool
+	done     chan struct{}
+	devices  map[string]Device
+	diags    []DeviceError
+	err      error
+}
+
+// ScanDevices is the singleflight wrapper around GetDevices. A manual
+// rescan (SIGHUP) firing while the periodic scan is already running
+// waits for that scan and returns its result.
+func ScanDevices() (map[string]Device, []DeviceError, error) {
+	scanGroup.Lock()
+	if scanGroup.inflight {
+		done := scanGroup.done
+		scanGroup.Unlock()
+		<-done
+		scanGroup.Lock()
+		defer scanGroup.Unlock()
+		return scanGroup.devices, scanGroup.diags, scanGroup.err
+	}
+	scanGroup.inflight = true
+	scanGroup.done = make(chan struct{})
+	scanGroup.Unlock()
+
+	devices, diags, err := scanFunc()
+
+	scanGroup.Lock()
+	scanGroup.devices, scanGroup.diags, scanGroup.err = devices, diags, err
+	scanGroup.inflight = false
+	close(scanGroup.done)
+	scanGroup.Unlock()
+	return devices, diags, err
+}
+
+// lastDiagLog suppresses repeated logging of an unchanged diagnostics
+// set; the scan runs every few seconds and skipped cards are usually
+// skipped for a while.
+var lastDiagLog string
+
+// logDeviceDiags reports the cards a scan skipped, once per distinct
+// set of reasons.
+func logDeviceDiags(diags []DeviceError) {
+	fingerprint := ""
+	for _, diag := range diags {
+		fingerprint += diag.Error() + "\n"
+	}
+	if fingerprint == lastDiagLog {
+		return
+	}
+	lastDiagLog = fingerprint
+	for _, diag := range diags {
+		logger.Warnf("%s", diag.Error())
+	}
+}
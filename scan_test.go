@@ -0,0 +1,73 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScanDevicesSingleflight(t *testing.T) {
+	const callers = 5
+
+	var scans int32
+	started := make(chan struct{}, callers)
+	release := make(chan struct{})
+	defer func() { scanFunc = GetDevicesCached }()
+	// a slow fake scan: signals that it is running, then blocks until
+	// every caller has had the chance to pile up behind it
+	scanFunc = func() (map[string]Device, []DeviceError, error) {
+		atomic.AddInt32(&scans, 1)
+		started <- struct{}{}
+		<-release
+		return map[string]Device{"serialA": {sn: "serialA"}}, nil, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]map[string]Device, callers)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], _, _ = ScanDevices()
+	}()
+	<-started
+
+	// these arrive while the first scan is still in flight
+	for i := 1; i < callers; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _, _ = ScanDevices()
+		}()
+	}
+	// give the joiners time to park inside ScanDevices before the
+	// in-flight scan is allowed to finish
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&scans); n != 1 {
+		t.Fatalf("%d scans ran, want 1", n)
+	}
+	for i, result := range results {
+		if _, ok := result["serialA"]; !ok {
+			t.Errorf("caller %d did not share the scan result: %v", i, result)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// selfTestNode checks one device node: it must stat and be openable
+// read-only, since that's the least the plugin will hand to a pod.
+// Returns "" on success or the reason for failure.
+func selfTestNode(devNode string) string {
+	if _, err := os.Stat(devNode); err != nil {
+		return "missing"
+	}
+	f, err := os.Open(devNode)
+	if err != nil {
+		return fmt.Sprintf("unopenable: %v", err)
+	}
+	f.Close()
+	return ""
+}
+
+// runSelfTest runs discovery and probes every device node the plugin
+// would mount into containers, printing a pass/fail table. It returns
+// the process exit code: 0 when every node passed. This turns Allocate
+// failures that would otherwise only show up when a pod lands on the
+// node into an immediate startup error.
+func runSelfTest() int {
+	devices, diags, err := ScanDevices()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	for _, diag := range diags {
+		fmt.Fprintf(os.Stderr, "%s\n", diag.Error())
+	}
+
+	failures := 0
+	w := tabwriter.NewWriter(os.Stdout, 2, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CARD\tNODE\tRESULT")
+	probe := func(sn, devNode string) {
+		if devNode == "" {
+			return
+		}
+		result := "PASS"
+		if reason := selfTestNode(devNode); reason != "" {
+			result = "FAIL (" + reason + ")"
+			failures++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", sn, devNode, result)
+	}
+	for sn, device := range devices {
+		for _, node := range device.Nodes {
+			probe(sn, node.User)
+			probe(sn, node.SubdevPath)
+			for _, subdev := range node.SubdevNodes {
+				probe(sn, subdev)
+			}
+			if len(node.Qdmas) > 0 {
+				for _, qdma := range node.Qdmas {
+					probe(sn, qdma)
+				}
+			} else {
+				probe(sn, node.Qdma)
+			}
+			for _, extra := range node.ExtraDevices {
+				probe(sn, extra)
+			}
+		}
+	}
+	w.Flush()
+
+	if failures > 0 {
+		fmt.Printf("\n%d node(s) failed the self test\n", failures)
+		return 1
+	}
+	fmt.Printf("\nall device nodes of %d card(s) passed\n", len(devices))
+	return 0
+}
@@ -0,0 +1,51 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSelfTestNode(t *testing.T) {
+	dir := t.TempDir()
+	node := path.Join(dir, "renderD128")
+	if err := ioutil.WriteFile(node, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if reason := selfTestNode(node); reason != "" {
+		t.Errorf("existing node failed: %s", reason)
+	}
+	if reason := selfTestNode(path.Join(dir, "absent")); reason != "missing" {
+		t.Errorf("missing node reported %q, want missing", reason)
+	}
+
+	// root opens anything regardless of mode, so the permission case
+	// only holds for unprivileged runs
+	if os.Geteuid() != 0 {
+		locked := path.Join(dir, "locked")
+		if err := ioutil.WriteFile(locked, nil, 0000); err != nil {
+			t.Fatal(err)
+		}
+		if reason := selfTestNode(locked); !strings.HasPrefix(reason, "unopenable") {
+			t.Errorf("unreadable node reported %q, want unopenable", reason)
+		}
+	}
+}
@@ -26,13 +26,17 @@ import (
 	"reflect"
 	_ "runtime/debug"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-const (
-	resourceNamePrefix = "xilinx.com/fpga"
-	serverSockPath     = pluginapi.DevicePluginPath
-)
+const serverSockPath = pluginapi.DevicePluginPath
+
+// resourceNamePrefix is the domain/base prefix every advertised
+// resource shares; -resource-prefix and -resource-name override it for
+// multi-vendor clusters and testing.
+var resourceNamePrefix = "xilinx.com/fpga"
 
 // FPGADevicePluginServer implements the Kubernetes device plugin API
 type FPGADevicePluginServer struct {
@@ -42,13 +46,109 @@ type FPGADevicePluginServer struct {
 	stop    chan interface{}
 	update  chan map[string]Device
 
+	// allocated tracks the serials handed to pods, so a rescan never
+	// drops a card that is in use
+	allocMutex sync.Mutex
+	allocated  map[string]bool
+
+	// plugin points back at the owning plugin for cross-pool updates;
+	// nil in tests
+	plugin *FPGADevicePlugin
+
 	server *grpc.Server
 }
 
+// markAllocated records that the card was handed to a pod.
+func (m *FPGADevicePluginServer) markAllocated(sn string) {
+	m.allocMutex.Lock()
+	defer m.allocMutex.Unlock()
+	if m.allocated == nil {
+		m.allocated = make(map[string]bool)
+	}
+	m.allocated[sn] = true
+}
+
+// isAllocated reports whether the card was ever handed to a pod. The
+// v1beta1 API has no deallocation callback, so this errs on the side of
+// treating a card as in use.
+func (m *FPGADevicePluginServer) isAllocated(sn string) bool {
+	m.allocMutex.Lock()
+	defer m.allocMutex.Unlock()
+	return m.allocated[sn]
+}
+
 type FPGADevicePlugin struct {
 	devices    map[string]map[string]Device
 	servers    map[string]*FPGADevicePluginServer
 	updateChan chan map[string]map[string]Device
+	// firstSeen tracks when each card was first seen healthy, for the
+	// settle grace period
+	firstSeen map[string]time.Time
+	// debounce holds back health transitions until they persist across
+	// scans
+	debounce *healthDebouncer
+	// stopScan ends the scan goroutine on teardown
+	stopScan chan struct{}
+}
+
+// scanInterval is how often the device scan polls sysfs for presence
+// and health changes between the pushes to kubelet.
+var scanInterval = 5 * time.Second
+
+// settlePeriod is how long a freshly appeared card must stay healthy
+// before it is advertised to kubelet. Zero advertises immediately.
+var settlePeriod time.Duration
+
+// degradedPolicy decides how the internal Degraded level is reported
+// to kubelet: "unhealthy" (the default) withholds such cards from
+// scheduling, "healthy" keeps them schedulable at reduced performance.
+var degradedPolicy = "unhealthy"
+
+// degradedHealth maps HealthDegraded onto the two levels kubelet
+// understands, per the configured policy.
+func degradedHealth() string {
+	if degradedPolicy == "healthy" {
+		return pluginapi.Healthy
+	}
+	return pluginapi.Unhealthy
+}
+
+// applySettlePeriod drops cards from devMap that have not yet been seen
+// healthy for settlePeriod. A card that goes unhealthy (or disappears)
+// has to settle again from scratch after recovering.
+func (m *FPGADevicePlugin) applySettlePeriod(devMap map[string]map[string]Device) map[string]map[string]Device {
+	if settlePeriod == 0 {
+		return devMap
+	}
+	now := time.Now()
+	seen := make(map[string]bool)
+	for devType, subMap := range devMap {
+		for sn, device := range subMap {
+			seen[sn] = true
+			if device.Healthy != pluginapi.Healthy {
+				m.firstSeen[sn] = now
+				continue
+			}
+			first, ok := m.firstSeen[sn]
+			if !ok {
+				m.firstSeen[sn] = now
+				first = now
+			}
+			if now.Sub(first) < settlePeriod {
+				log.Debugf("Card %s settling since %v, not yet advertised", sn, first)
+				delete(subMap, sn)
+				if len(subMap) == 0 {
+					delete(devMap, devType)
+				}
+			}
+		}
+	}
+	for sn := range m.firstSeen {
+		if !seen[sn] {
+			delete(m.firstSeen, sn)
+		}
+	}
+	return devMap
 }
 
 // NewFPGADevicePlugin returns an initialized FPGADevicePlugin
@@ -59,18 +159,26 @@ func NewFPGADevicePlugin() *FPGADevicePlugin {
 		devices:    make(map[string]map[string]Device),
 		servers:    make(map[string]*FPGADevicePluginServer),
 		updateChan: updateChan,
+		firstSeen:  make(map[string]time.Time),
+		debounce:   newHealthDebouncer(),
+		stopScan:   make(chan struct{}),
 	}
 
+	// rescan immediately on hotplug events; the timer below stays as
+	// the fallback when inotify is unavailable
+	hotplug := newHotplugWatcher(SysfsDevices)
 	go func() {
+		defer close(updateChan)
 		for {
-			devices, err := GetDevices()
+			devices, diags, err := ScanDevices()
 			if err != nil {
 				log.Errorf("Error to get FPGA devices: %v", err)
-				break
+				return
 			}
+			logDeviceDiags(diags)
 			devMap := make(map[string]map[string]Device)
 			for sn, device := range devices {
-				DSAtype := device.shellVer + "-" + device.timestamp + "-" + strconv.Itoa(len(device.Nodes))
+				DSAtype := resourceNameOf(device)
 				id := sn
 				if subMap, ok := devMap[DSAtype]; ok {
 					subMap = devMap[DSAtype]
@@ -81,16 +189,56 @@ func NewFPGADevicePlugin() *FPGADevicePlugin {
 					subMap[id] = device
 				}
 			}
+			// debounce before the settle period, so a settling card is
+			// judged on its debounced health
+			devMap = plugin.debounce.apply(devMap)
+			devMap = plugin.applySettlePeriod(devMap)
+			addCapabilityPools(devMap)
 			//log.Debugf("newly reported FPGA device list: %v", devMap)
-			updateChan <- devMap
-			time.Sleep(5 * time.Second)
+			select {
+			case updateChan <- devMap:
+			case <-plugin.stopScan:
+				return
+			}
+			// a nil hotplug channel never fires, leaving pure polling
+			select {
+			case <-time.After(scanInterval):
+			case <-hotplug:
+				log.Debugf("Hotplug event, rescanning early")
+			case <-plugin.stopScan:
+				return
+			}
 		}
-		close(updateChan)
 	}()
 
 	return &plugin
 }
 
+// Stop tears the plugin down: the scan goroutine exits and every
+// per-resource gRPC server is stopped. Stopping a server closes its
+// update channel, which ends the in-flight ListAndWatch stream cleanly,
+// and removes its unix socket. The plugin is not reusable afterwards;
+// the main loop builds a fresh one to re-register with kubelet.
+func (m *FPGADevicePlugin) Stop() {
+	close(m.stopScan)
+	for devType, server := range m.servers {
+		server.Stop()
+		delete(m.servers, devType)
+		delete(m.devices, devType)
+	}
+}
+
+// ownsSocket reports whether name is the unix socket of one of the
+// plugin's running per-resource servers.
+func (m *FPGADevicePlugin) ownsSocket(name string) bool {
+	for _, server := range m.servers {
+		if server.socket == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *FPGADevicePlugin) checkDeviceUpdate(n map[string]map[string]Device) {
 	added := make(map[string]map[string]Device)
 	updated := make(map[string]map[string]Device)
@@ -120,23 +268,48 @@ func (m *FPGADevicePlugin) checkDeviceUpdate(n map[string]map[string]Device) {
 		m.servers[aDevType] = devicePluginServer
 		go func(aDevType string, aDevices map[string]Device, name string) {
 			if err := m.servers[aDevType].Serve(name); err != nil {
-				log.Println("Could not contact Kubelet, Exit. Did you enable the device plugin feature gate?")
-				os.Exit(1)
+				// don't exit: every resource re-registers once kubelet
+				// recreates its socket, which the main loop watches for
+				log.Errorf("Could not register %s with Kubelet: %v. Did you enable the device plugin feature gate?", name, err)
+				return
 			}
 			m.servers[aDevType].update <- aDevices
 		}(aDevType, aDevices, resourceNamePrefix+"-"+aDevType)
 	}
 
-	//stop server for removed devices
+	//stop server for removed devices, retaining cards that are in use:
+	//a transient read failure mid-scan must not invalidate a card a pod
+	//is currently using
 	for rDevType, rDevices := range removed {
+		retained := make(map[string]Device)
+		for sn, dev := range rDevices {
+			if m.servers[rDevType].isAllocated(sn) {
+				retained[sn] = dev
+			}
+		}
+		if len(retained) > 0 {
+			log.Warnf("Keeping %d in-use device(s) of %s that vanished from the scan", len(retained), rDevType)
+			m.devices[rDevType] = retained
+			m.servers[rDevType].update <- retained
+			continue
+		}
 		log.Debugf("Remove device %v", rDevices)
 		m.servers[rDevType].Stop()
 		delete(m.servers, rDevType)
 		delete(m.devices, rDevType)
 	}
 
-	//send update for updated devices
+	//send update for updated devices, again retaining in-use cards that
+	//dropped out of this scan
 	for uDevType, uDevices := range updated {
+		if server, ok := m.servers[uDevType]; ok {
+			for sn, oDev := range m.devices[uDevType] {
+				if _, ok := uDevices[sn]; !ok && server.isAllocated(sn) {
+					log.Warnf("Keeping in-use device %s that vanished from the scan", sn)
+					uDevices[sn] = oDev
+				}
+			}
+		}
 		m.devices[uDevType] = uDevices
 		m.servers[uDevType].update <- uDevices
 	}
@@ -150,6 +323,30 @@ func (m *FPGADevicePlugin) NewFPGADevicePluginServer(devType string, devices map
 		socket:  path.Join(serverSockPath, devType+"-fpga.sock"),
 		stop:    make(chan interface{}),
 		update:  make(chan map[string]Device, 1),
+		plugin:  m,
+	}
+}
+
+// notifyPools makes every other pool containing sn resend its device
+// list, so a card claimed through one pool promptly turns Unhealthy in
+// the rest.
+func (m *FPGADevicePlugin) notifyPools(sn, claimedPool string) {
+	for devType, server := range m.servers {
+		if devType == claimedPool {
+			continue
+		}
+		devices, ok := m.devices[devType]
+		if !ok {
+			continue
+		}
+		if _, ok := devices[sn]; !ok {
+			continue
+		}
+		select {
+		case server.update <- devices:
+		default:
+			// an update is already pending; it will carry the change
+		}
 	}
 }
 
@@ -174,13 +371,56 @@ func waitForServer(socket string, timeout time.Duration) error {
 	return nil
 }
 
-func (m *FPGADevicePluginServer) deviceExists(id string) bool {
-	for k, _ := range m.devices {
-		if k == id {
-			return true
-		}
+// cuSharing advertises each card once per compute unit of its loaded
+// xclbin, so up to cuCount pods can share the card at CU granularity.
+var cuSharing bool
+
+// oversubscribe advertises each card this many times, letting up to N
+// latency-tolerant pods share one physical device. 1 keeps cards
+// exclusive.
+var oversubscribe = 1
+
+// replicasOf returns how many device IDs to advertise for one card.
+// CU sharing and oversubscription stack: N pods per compute unit.
+func replicasOf(device Device) int {
+	replicas := 1
+	if cuSharing && device.cuCount > 1 {
+		replicas = device.cuCount
 	}
-	return false
+	if oversubscribe > 1 {
+		replicas *= oversubscribe
+	}
+	return replicas
+}
+
+// replicaID derives the advertised ID for replica i of a card. Cards
+// advertised once keep their bare serial number as before.
+func replicaID(device Device, i int) string {
+	if replicasOf(device) == 1 {
+		return device.sn
+	}
+	return fmt.Sprintf("%s-%d", device.sn, i)
+}
+
+// resolveDeviceID maps an advertised ID back to the underlying device
+// and the replica index encoded in it.
+func (m *FPGADevicePluginServer) resolveDeviceID(id string) (Device, int, bool) {
+	if dev, ok := m.devices[id]; ok {
+		return dev, 0, true
+	}
+	idx := strings.LastIndex(id, "-")
+	if idx < 0 {
+		return Device{}, 0, false
+	}
+	dev, ok := m.devices[id[:idx]]
+	if !ok {
+		return Device{}, 0, false
+	}
+	i, err := strconv.Atoi(id[idx+1:])
+	if err != nil || i < 0 || i >= replicasOf(dev) {
+		return Device{}, 0, false
+	}
+	return dev, i, true
 }
 
 func (m *FPGADevicePluginServer) PreStartContainer(ctx context.Context, rqt *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
@@ -267,11 +507,38 @@ func (m *FPGADevicePluginServer) Register(kubeletEndpoint, resourceName string)
 	return nil
 }
 
-func (m *FPGADevicePluginServer) sendDevices(s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	resp := new(pluginapi.ListAndWatchResponse)
+// listDevices builds the device list reported to kubelet, mapping the
+// internal health levels and pool ownership onto Healthy/Unhealthy.
+func (m *FPGADevicePluginServer) listDevices() []*pluginapi.Device {
+	var devices []*pluginapi.Device
 	for _, device := range m.devices {
-		resp.Devices = append(resp.Devices, &pluginapi.Device{device.sn, device.Healthy})
+		health := device.Healthy
+		// kubelet only understands Healthy/Unhealthy; where degraded
+		// cards land is an operator tradeoff between capacity and
+		// performance
+		if health == HealthDegraded {
+			health = degradedHealth()
+		}
+		// a card allocated through another pool is no longer available
+		// in this one
+		if owner, ok := capAccounting.ownerOf(device.sn); ok && owner != m.devType {
+			health = pluginapi.Unhealthy
+		}
+		for i := 0; i < replicasOf(device); i++ {
+			// the v1beta1 API vendored here predates TopologyInfo, so
+			// NUMA affinity cannot be attached to the Device itself; it
+			// reaches the pod through XILINX_FPGA_NUMA_NODE in Allocate
+			// and the debug listing instead (cards without affinity,
+			// numa_node -1, carry no hint at all)
+			devices = append(devices, &pluginapi.Device{ID: replicaID(device, i), Health: health})
+		}
 	}
+	return devices
+}
+
+func (m *FPGADevicePluginServer) sendDevices(s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	resp := new(pluginapi.ListAndWatchResponse)
+	resp.Devices = m.listDevices()
 	log.Printf("Sending %d device(s) %v to kubelet", len(resp.Devices), resp.Devices)
 	if err := s.Send(resp); err != nil {
 		m.Stop()
@@ -285,6 +552,12 @@ func (m *FPGADevicePluginServer) sendDevices(s pluginapi.DevicePlugin_ListAndWat
 func (m *FPGADevicePluginServer) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
 	log.Debugf("In ListAndWatch(%s): stream: %v", m.devType, s)
 	//debug.PrintStack()
+	// kubelet expects the current inventory immediately on stream open;
+	// afterwards a response is pushed only when presence or health
+	// actually changed
+	if err := m.sendDevices(s); err != nil {
+		return err
+	}
 	for m.devices = range m.update {
 		if err := m.sendDevices(s); err != nil {
 			return err
@@ -302,39 +575,117 @@ func (m *FPGADevicePluginServer) Allocate(ctx context.Context, req *pluginapi.Al
 		log.Debugf("Request IDs: %v", creq.DevicesIDs)
 		cres := new(pluginapi.ContainerAllocateResponse)
 		for _, id := range creq.DevicesIDs {
-			log.Printf("Receiving request %s", id)
-			devs, ok := m.devices[id]
+			log.WithFields(log.Fields{
+				"device":   id,
+				"resource": m.devType,
+			}).Info("Receiving allocation request")
+			// a board removed between ListAndWatch and Allocate resolves
+			// to nothing; erroring out makes the kubelet reschedule
+			devs, cuIndex, ok := m.resolveDeviceID(id)
 			if !ok {
+				countAllocFailure(allocFailMissingDevice, id)
 				return nil, fmt.Errorf("Invalid allocation request with non-existing device %s", id)
 			}
-			if !m.deviceExists(id) {
-				return nil, fmt.Errorf("invalid allocation request: unknown device: %s", id)
+			if capabilityPools && !capAccounting.claim(devs.sn, m.devType) {
+				countAllocFailure(allocFailPoolConflict, devs.sn)
+				return nil, fmt.Errorf("device %s is already allocated through another pool", devs.sn)
+			}
+			// tell the container which CU it owns when the card is
+			// shared at CU granularity; with oversubscription stacked
+			// on top the replica index wraps around the CU count
+			if cuSharing && devs.cuCount > 1 {
+				if cres.Envs == nil {
+					cres.Envs = make(map[string]string)
+				}
+				cres.Envs["XILINX_FPGA_CU_INDEX"] = strconv.Itoa(cuIndex % devs.cuCount)
 			}
 
+			// let the container know which application bitstream is
+			// loaded; cards with no user image leave this unset
+			if devs.xclbinUUID != "" {
+				if cres.Envs == nil {
+					cres.Envs = make(map[string]string)
+				}
+				cres.Envs["XILINX_FPGA_XCLBIN_UUID"] = devs.xclbinUUID
+			}
+
+			// all device nodes of the card go to the container together
+			cres.Devices = append(cres.Devices, devs.DeviceSpecs()...)
+
 			for _, dev := range devs.Nodes {
-				cres.Devices = append(cres.Devices, &pluginapi.DeviceSpec{
-					HostPath:      dev.User,
-					ContainerPath: dev.User,
-					Permissions:   "rwm",
-				})
-				cres.Mounts = append(cres.Mounts, &pluginapi.Mount{
-					HostPath:      dev.User,
-					ContainerPath: dev.User,
-					ReadOnly:      false,
-				})
-				cres.Mounts = append(cres.Mounts, &pluginapi.Mount{
-					HostPath:      dev.SubdevPath,
-					ContainerPath: dev.SubdevPath,
-					ReadOnly:      true,
-				})
-				// if this device supports qdma, assign the qdma node to pod too
-				if dev.Qdma != "" {
-					cres.Devices = append(cres.Devices, &pluginapi.DeviceSpec{
-						HostPath:      dev.Qdma,
-						ContainerPath: dev.Qdma,
-						Permissions:   "rwm",
+				if dev.User != "" {
+					cres.Mounts = append(cres.Mounts, &pluginapi.Mount{
+						HostPath:      dev.User,
+						ContainerPath: dev.User,
+						ReadOnly:      false,
 					})
 				}
+				// the vendored v1beta1 API predates TopologyInfo, so the
+				// card's NUMA affinity travels as an env for the pod to
+				// pin itself with; -1 (no affinity) sets nothing
+				if dev.NUMA >= 0 {
+					if cres.Envs == nil {
+						cres.Envs = make(map[string]string)
+					}
+					numa := strconv.Itoa(dev.NUMA)
+					if prev, ok := cres.Envs["XILINX_FPGA_NUMA_NODE"]; ok && prev != numa {
+						numa = prev + "," + numa
+					}
+					cres.Envs["XILINX_FPGA_NUMA_NODE"] = numa
+				}
+				if dev.AWSSlot != "" {
+					if cres.Envs == nil {
+						cres.Envs = make(map[string]string)
+					}
+					// tell the container which F1 slot(s) it owns
+					slots := dev.AWSSlot
+					if prev, ok := cres.Envs["AWS_FPGA_SLOTS"]; ok {
+						slots = prev + "," + slots
+					}
+					cres.Envs["AWS_FPGA_SLOTS"] = slots
+				}
+				// when the per-instance subdev nodes could not be
+				// enumerated, fall back to mounting the whole directory
+				// for drivers without per-instance naming
+				if len(dev.SubdevNodes) == 0 && dev.SubdevPath != "" {
+					cres.Mounts = append(cres.Mounts, &pluginapi.Mount{
+						HostPath:      dev.SubdevPath,
+						ContainerPath: dev.SubdevPath,
+						ReadOnly:      true,
+					})
+				}
+			}
+
+			// attach the curated raw attribute values for downstream
+			// controllers reading the allocation
+			for _, attr := range deviceAttributes {
+				if val := deviceAttribute(devs, attr); val != "" {
+					if cres.Annotations == nil {
+						cres.Annotations = make(map[string]string)
+					}
+					cres.Annotations[attrAnnotationPrefix+attr] = val
+				}
+			}
+
+			// apply operator configured extras for this card
+			if extras, ok := allocExtras[devs.sn]; ok {
+				for env, val := range extras.Envs {
+					if cres.Envs == nil {
+						cres.Envs = make(map[string]string)
+					}
+					cres.Envs[env] = val
+				}
+				for _, mount := range extras.Mounts {
+					cres.Mounts = append(cres.Mounts, &pluginapi.Mount{
+						HostPath:      mount.HostPath,
+						ContainerPath: mount.ContainerPath,
+						ReadOnly:      mount.ReadOnly,
+					})
+				}
+			}
+			m.markAllocated(devs.sn)
+			if capabilityPools && m.plugin != nil {
+				m.plugin.notifyPools(devs.sn, m.devType)
 			}
 		}
 		response.ContainerResponses = append(response.ContainerResponses, cres)
@@ -343,6 +694,33 @@ func (m *FPGADevicePluginServer) Allocate(ctx context.Context, req *pluginapi.Al
 	return response, nil
 }
 
+// Registration races kubelet's own startup: kubelet.sock can exist
+// before kubelet accepts Register calls, especially right after a
+// restart. Failures are retried with doubling backoff before giving up.
+var (
+	registerRetries    = 5
+	registerRetryDelay = time.Second
+)
+
+// withRegisterRetries runs register until it succeeds or the retry
+// budget is spent, backing off between attempts.
+func withRegisterRetries(register func() error) error {
+	delay := registerRetryDelay
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = register(); err == nil {
+			return nil
+		}
+		if attempt >= registerRetries {
+			return err
+		}
+		log.Warnf("Registration failed (attempt %d of %d), retrying in %v: %v",
+			attempt+1, registerRetries+1, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
 // Serve starts the gRPC server and register the device plugin to Kubelet
 func (m *FPGADevicePluginServer) Serve(resourceName string) error {
 	log.Debugf("In Serve(%s)", m.socket)
@@ -353,7 +731,9 @@ func (m *FPGADevicePluginServer) Serve(resourceName string) error {
 	}
 	log.Infof("Starting to serve on %s", m.socket)
 
-	err = m.Register(pluginapi.KubeletSocket, resourceName)
+	err = withRegisterRetries(func() error {
+		return m.Register(pluginapi.KubeletSocket, resourceName)
+	})
 	if err != nil {
 		log.Errorf("Could not register device plugin: %v", err)
 		m.Stop()
@@ -0,0 +1,519 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+// testServer builds a server with one discovered card for Allocate
+// tests.
+func testServer() *FPGADevicePluginServer {
+	return &FPGADevicePluginServer{
+		devType: "test",
+		devices: map[string]Device{
+			"serialA": {
+				sn:        "serialA",
+				shellVer:  "xilinx_u250_xdma_201830_2",
+				timestamp: "1561465320",
+				Healthy:   pluginapi.Healthy,
+				Nodes: []Node{{
+					User:       "/dev/dri/renderD128",
+					SubdevPath: "/dev/xfpga",
+					DBDF:       "0000:65:00.1",
+				}},
+			},
+		},
+	}
+}
+
+func TestAllocateDeviceSpecs(t *testing.T) {
+	server := testServer()
+	device := server.devices["serialA"]
+	device.Nodes[0].SubdevNodes = []string{"/dev/xfpga/xvc_pub.u25857"}
+	device.Nodes[0].Qdma = "/dev/xfpga/dma.qdma.u25857"
+	server.devices["serialA"] = device
+
+	resp, err := server.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"serialA"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := resp.ContainerResponses[0].Devices
+	want := map[string]bool{
+		"/dev/dri/renderD128":        false,
+		"/dev/xfpga/xvc_pub.u25857":  false,
+		"/dev/xfpga/dma.qdma.u25857": false,
+	}
+	for _, spec := range devices {
+		if spec.Permissions != "rwm" {
+			t.Errorf("device %s has permissions %q, want rwm", spec.HostPath, spec.Permissions)
+		}
+		if spec.ContainerPath != spec.HostPath {
+			t.Errorf("device %s mapped to %s", spec.HostPath, spec.ContainerPath)
+		}
+		if _, ok := want[spec.HostPath]; !ok {
+			t.Errorf("unexpected device %s in response", spec.HostPath)
+			continue
+		}
+		want[spec.HostPath] = true
+	}
+	for path, seen := range want {
+		if !seen {
+			t.Errorf("device %s missing from response", path)
+		}
+	}
+
+	// a card that vanished between ListAndWatch and Allocate is an error,
+	// so the kubelet reschedules instead of starting a broken pod
+	delete(server.devices, "serialA")
+	if _, err := server.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"serialA"}},
+		},
+	}); err == nil {
+		t.Error("allocation of a removed board did not fail")
+	}
+}
+
+func TestAllocateAttributeAnnotations(t *testing.T) {
+	deviceAttributes = []string{"serial", "shell", "dbdf"}
+	defer func() { deviceAttributes = nil }()
+
+	server := testServer()
+	resp, err := server.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"serialA"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.ContainerResponses) != 1 {
+		t.Fatalf("expected 1 container response, got %d", len(resp.ContainerResponses))
+	}
+	annotations := resp.ContainerResponses[0].Annotations
+	want := map[string]string{
+		attrAnnotationPrefix + "serial": "serialA",
+		attrAnnotationPrefix + "shell":  "xilinx_u250_xdma_201830_2",
+		attrAnnotationPrefix + "dbdf":   "0000:65:00.1",
+	}
+	for key, val := range want {
+		if annotations[key] != val {
+			t.Errorf("annotation %s = %q, want %q", key, annotations[key], val)
+		}
+	}
+	// timestamp was not in the curated set and must not be attached
+	if _, ok := annotations[attrAnnotationPrefix+"timestamp"]; ok {
+		t.Error("timestamp annotation attached but not configured")
+	}
+}
+
+func TestRescanRetainsAllocatedDevices(t *testing.T) {
+	server := testServer()
+	server.update = make(chan map[string]Device, 1)
+	plugin := &FPGADevicePlugin{
+		devices: map[string]map[string]Device{
+			"test": server.devices,
+		},
+		servers: map[string]*FPGADevicePluginServer{
+			"test": server,
+		},
+		firstSeen: make(map[string]time.Time),
+	}
+	server.markAllocated("serialA")
+
+	// a mid-scan read failure makes the in-use card vanish entirely
+	plugin.checkDeviceUpdate(map[string]map[string]Device{})
+
+	devices, ok := plugin.devices["test"]
+	if !ok {
+		t.Fatal("device type dropped although a card is in use")
+	}
+	if _, ok := devices["serialA"]; !ok {
+		t.Fatal("in-use card serialA dropped by rescan")
+	}
+
+	// once nothing is allocated, a disappearing card really goes away
+	unused := &FPGADevicePluginServer{
+		devType: "idle",
+		devices: map[string]Device{"serialB": {sn: "serialB"}},
+		update:  make(chan map[string]Device, 1),
+	}
+	plugin.devices["idle"] = unused.devices
+	plugin.servers["idle"] = unused
+	plugin.checkDeviceUpdate(map[string]map[string]Device{
+		"test": {"serialA": server.devices["serialA"]},
+	})
+	if _, ok := plugin.devices["idle"]; ok {
+		t.Error("unallocated device type should have been removed")
+	}
+}
+
+func TestAllocateXclbinEnv(t *testing.T) {
+	server := testServer()
+	device := server.devices["serialA"]
+	device.xclbinUUID = "c8b69ba1-2b4e-43c5-9f5e-53b8b5c4e2ae"
+	server.devices["serialA"] = device
+
+	resp, err := server.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"serialA"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envs := resp.ContainerResponses[0].Envs
+	if envs["XILINX_FPGA_XCLBIN_UUID"] != device.xclbinUUID {
+		t.Errorf("XILINX_FPGA_XCLBIN_UUID = %q, want %q", envs["XILINX_FPGA_XCLBIN_UUID"], device.xclbinUUID)
+	}
+
+	// no user image loaded means no env at all
+	device.xclbinUUID = ""
+	server.devices["serialA"] = device
+	resp, err = server.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"serialA"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := resp.ContainerResponses[0].Envs["XILINX_FPGA_XCLBIN_UUID"]; ok {
+		t.Error("XILINX_FPGA_XCLBIN_UUID set although no xclbin is loaded")
+	}
+}
+
+func TestAllocateNUMAEnv(t *testing.T) {
+	server := testServer()
+	device := server.devices["serialA"]
+	device.Nodes[0].NUMA = 1
+	server.devices["serialA"] = device
+
+	resp, err := server.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"serialA"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.ContainerResponses[0].Envs["XILINX_FPGA_NUMA_NODE"]; got != "1" {
+		t.Errorf("XILINX_FPGA_NUMA_NODE = %q, want %q", got, "1")
+	}
+
+	// a board without NUMA affinity must not claim node 0
+	device.Nodes[0].NUMA = -1
+	server.devices["serialA"] = device
+	resp, err = server.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"serialA"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := resp.ContainerResponses[0].Envs["XILINX_FPGA_NUMA_NODE"]; ok {
+		t.Error("XILINX_FPGA_NUMA_NODE set for an unpinned board")
+	}
+}
+
+func TestOversubscribe(t *testing.T) {
+	defer func() { oversubscribe = 1 }()
+	oversubscribe = 3
+
+	server := testServer()
+	device := server.devices["serialA"]
+	if n := replicasOf(device); n != 3 {
+		t.Fatalf("replicasOf = %d, want 3", n)
+	}
+	if len(server.listDevices()) != 3 {
+		t.Errorf("listDevices advertised %d IDs, want 3", len(server.listDevices()))
+	}
+
+	// every replica ID resolves back to the real card and mounts its
+	// actual device nodes
+	resp, err := server.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{replicaID(device, 2)}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := resp.ContainerResponses[0].Devices
+	if len(devices) != 1 || devices[0].HostPath != "/dev/dri/renderD128" {
+		t.Errorf("oversubscribed ID did not resolve to the real nodes: %v", devices)
+	}
+	// without cu-sharing, no CU index is handed out
+	if _, ok := resp.ContainerResponses[0].Envs["XILINX_FPGA_CU_INDEX"]; ok {
+		t.Error("oversubscription alone must not set XILINX_FPGA_CU_INDEX")
+	}
+
+	oversubscribe = 1
+	if n := replicasOf(device); n != 1 {
+		t.Errorf("default replicasOf = %d, want 1", n)
+	}
+}
+
+func TestDeviceSplitHealthPropagation(t *testing.T) {
+	defer func() { oversubscribe = 1 }()
+	oversubscribe = 2
+
+	server := testServer()
+	devices := server.listDevices()
+	if len(devices) != 2 {
+		t.Fatalf("advertised %d IDs, want 2", len(devices))
+	}
+	wantIDs := map[string]bool{"serialA-0": false, "serialA-1": false}
+	for _, dev := range devices {
+		if _, ok := wantIDs[dev.ID]; !ok {
+			t.Errorf("unexpected replica ID %q", dev.ID)
+			continue
+		}
+		wantIDs[dev.ID] = true
+		if dev.Health != pluginapi.Healthy {
+			t.Errorf("replica %s health = %s", dev.ID, dev.Health)
+		}
+	}
+	for id, seen := range wantIDs {
+		if !seen {
+			t.Errorf("replica %s missing from ListAndWatch", id)
+		}
+	}
+
+	// a board going unhealthy takes every replica with it
+	device := server.devices["serialA"]
+	device.Healthy = pluginapi.Unhealthy
+	server.devices["serialA"] = device
+	for _, dev := range server.listDevices() {
+		if dev.Health != pluginapi.Unhealthy {
+			t.Errorf("replica %s stayed %s after the board went unhealthy", dev.ID, dev.Health)
+		}
+	}
+}
+
+func TestWithRegisterRetries(t *testing.T) {
+	defer func(retries int, delay time.Duration) {
+		registerRetries, registerRetryDelay = retries, delay
+	}(registerRetries, registerRetryDelay)
+	registerRetries = 3
+	registerRetryDelay = time.Millisecond
+
+	// kubelet coming up mid-way: fail twice, then succeed
+	attempts := 0
+	err := withRegisterRetries(func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("recoverable registration failed: %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+
+	// a permanent failure surfaces after the budget is spent
+	attempts = 0
+	err = withRegisterRetries(func() error {
+		attempts++
+		return errors.New("feature gate disabled")
+	})
+	if err == nil {
+		t.Error("permanent failure did not surface")
+	}
+	if attempts != registerRetries+1 {
+		t.Errorf("attempts = %d, want %d", attempts, registerRetries+1)
+	}
+}
+
+func TestAllocateFailureCounters(t *testing.T) {
+	server := testServer()
+	before := allocFailureCounts()[allocFailMissingDevice]
+
+	for i := 0; i < 2; i++ {
+		_, err := server.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+				{DevicesIDs: []string{"no-such-serial"}},
+			},
+		})
+		if err == nil {
+			t.Fatal("expected allocation of unknown device to fail")
+		}
+	}
+
+	after := allocFailureCounts()[allocFailMissingDevice]
+	if after != before+2 {
+		t.Errorf("%s counter = %d, want %d", allocFailMissingDevice, after, before+2)
+	}
+}
+
+func TestDegradedPolicy(t *testing.T) {
+	server := testServer()
+	device := server.devices["serialA"]
+	device.Healthy = HealthDegraded
+	device.degradedReason = "xmc_temp over soft threshold"
+	server.devices["serialA"] = device
+	defer func() { degradedPolicy = "unhealthy" }()
+
+	degradedPolicy = "unhealthy"
+	devices := server.listDevices()
+	if len(devices) != 1 || devices[0].Health != pluginapi.Unhealthy {
+		t.Errorf("unhealthy policy reported %+v", devices)
+	}
+
+	degradedPolicy = "healthy"
+	devices = server.listDevices()
+	if len(devices) != 1 || devices[0].Health != pluginapi.Healthy {
+		t.Errorf("healthy policy reported %+v", devices)
+	}
+
+	// truly unhealthy cards are withheld regardless of policy
+	device.Healthy = pluginapi.Unhealthy
+	server.devices["serialA"] = device
+	devices = server.listDevices()
+	if len(devices) != 1 || devices[0].Health != pluginapi.Unhealthy {
+		t.Errorf("unhealthy card reported %+v under healthy policy", devices)
+	}
+}
+
+func TestParseDeviceAttributes(t *testing.T) {
+	attrs, err := parseDeviceAttributes("serial, shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attrs) != 2 {
+		t.Errorf("expected 2 attributes, got %v", attrs)
+	}
+	if _, err := parseDeviceAttributes("serial,bogus"); err == nil {
+		t.Error("expected error for unknown attribute")
+	}
+}
+
+// A freshly appeared card is withheld until it has stayed healthy for
+// settlePeriod, and an unhealthy scan restarts its settle clock.
+func TestApplySettlePeriod(t *testing.T) {
+	defer func() { settlePeriod = 0 }()
+	settlePeriod = 50 * time.Millisecond
+
+	plugin := &FPGADevicePlugin{firstSeen: make(map[string]time.Time)}
+	devMap := func(health string) map[string]map[string]Device {
+		return map[string]map[string]Device{
+			"fpga-xilinx_u250_xdma_201830_2-1561465320": {
+				"SN-A": {sn: "SN-A", Healthy: health},
+			},
+		}
+	}
+
+	// first sighting: withheld until the settle period has passed
+	if out := plugin.applySettlePeriod(devMap(pluginapi.Healthy)); len(out) != 0 {
+		t.Fatalf("fresh card advertised before settling: %v", out)
+	}
+	if out := plugin.applySettlePeriod(devMap(pluginapi.Healthy)); len(out) != 0 {
+		t.Fatalf("card advertised mid-settle: %v", out)
+	}
+	time.Sleep(settlePeriod + 10*time.Millisecond)
+	out := plugin.applySettlePeriod(devMap(pluginapi.Healthy))
+	if _, ok := out["fpga-xilinx_u250_xdma_201830_2-1561465320"]["SN-A"]; !ok {
+		t.Fatalf("settled card not advertised: %v", out)
+	}
+
+	// an unhealthy scan passes through as unhealthy (the settle period
+	// only holds back healthy advertising) but restarts the clock...
+	out = plugin.applySettlePeriod(devMap(pluginapi.Unhealthy))
+	if out["fpga-xilinx_u250_xdma_201830_2-1561465320"]["SN-A"].Healthy != pluginapi.Unhealthy {
+		t.Fatalf("unhealthy card dropped instead of reported: %v", out)
+	}
+	// ...so a recovered card has to settle again from scratch
+	if out := plugin.applySettlePeriod(devMap(pluginapi.Healthy)); len(out) != 0 {
+		t.Errorf("recovered card advertised without re-settling: %v", out)
+	}
+
+	// a card that disappears entirely also forgets its settle progress
+	time.Sleep(settlePeriod + 10*time.Millisecond)
+	plugin.applySettlePeriod(map[string]map[string]Device{})
+	if out := plugin.applySettlePeriod(devMap(pluginapi.Healthy)); len(out) != 0 {
+		t.Errorf("returned card advertised without re-settling: %v", out)
+	}
+}
+
+func TestPluginStopTearsDownScanAndServers(t *testing.T) {
+	defer func() { scanFunc = GetDevicesCached }()
+	scanFunc = func() (map[string]Device, []DeviceError, error) {
+		return map[string]Device{}, nil, nil
+	}
+
+	plugin := NewFPGADevicePlugin()
+	// drain one scan so the goroutine is demonstrably running
+	select {
+	case <-plugin.updateChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan goroutine never produced an update")
+	}
+
+	server := plugin.NewFPGADevicePluginServer("test", map[string]Device{})
+	server.socket = path.Join(t.TempDir(), "test-fpga.sock")
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	plugin.servers["test"] = server
+	if !plugin.ownsSocket(server.socket) {
+		t.Errorf("plugin does not recognize its own socket %s", server.socket)
+	}
+	if plugin.ownsSocket(path.Join(serverSockPath, "kubelet.sock")) {
+		t.Error("plugin claims a foreign socket")
+	}
+
+	plugin.Stop()
+	// the scan goroutine exits and closes the update channel
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-plugin.updateChan:
+			if !ok {
+				goto closed
+			}
+		case <-deadline:
+			t.Fatal("update channel not closed after Stop")
+		}
+	}
+closed:
+	if len(plugin.servers) != 0 {
+		t.Errorf("servers not torn down: %v", plugin.servers)
+	}
+	// a stopped server's update channel is closed, which is what ends
+	// its ListAndWatch stream
+	if _, ok := <-server.update; ok {
+		t.Error("server update channel still open after Stop")
+	}
+	if _, err := os.Stat(server.socket); !os.IsNotExist(err) {
+		t.Errorf("socket %s not removed after Stop", server.socket)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// topologyInfo describes where a card sits in the host topology. The
+// device plugin API vendored here predates TopologyInfo in ListAndWatch,
+// so the values are carried on the Node and surfaced through Allocate
+// and debug logging instead.
+type topologyInfo struct {
+	// NUMANode is the node reported by sysfs, -1 when unknown
+	NUMANode int
+	// ParentSwitch is the BDF of the upstream PCI bridge, empty when
+	// the card hangs directly off the root complex or the tree is flat
+	ParentSwitch string
+}
+
+// Topology is derived from sysfs once per card and cached, since it
+// only changes on hotplug. syncTopologyCache drops the cache whenever
+// the PCI device set changes so the next scan re-derives it.
+var (
+	topoMutex   sync.Mutex
+	topoCache   = make(map[string]topologyInfo)
+	topoLastSet string
+)
+
+// readTopology derives the topology of the device at devDir.
+func readTopology(devDir string) topologyInfo {
+	info := topologyInfo{NUMANode: -1}
+	if content, err := GetFileContent(path.Join(devDir, NumaNodeFile)); err == nil {
+		// sysfs reports -1 when the card has no NUMA affinity; keep
+		// that as "unknown" rather than letting it look like node 0
+		// downstream
+		if n, err := strconv.Atoi(content); err == nil && n >= 0 {
+			info.NUMANode = n
+		}
+	}
+	// the device dir is a symlink into the PCI hierarchy; its parent
+	// directory there is the upstream bridge, if any
+	if resolved, err := filepath.EvalSymlinks(devDir); err == nil {
+		parent := filepath.Base(filepath.Dir(resolved))
+		if bdfPattern.MatchString(parent) {
+			info.ParentSwitch = parent
+		}
+	}
+	return info
+}
+
+// getTopology returns the cached topology for pciID, deriving it on
+// first use after a cache drop.
+func getTopology(pciID string) topologyInfo {
+	topoMutex.Lock()
+	defer topoMutex.Unlock()
+	if info, ok := topoCache[pciID]; ok {
+		return info
+	}
+	info := readTopology(locator.DeviceDir(pciID))
+	topoCache[pciID] = info
+	return info
+}
+
+// syncTopologyCache compares the present PCI device names against the
+// previous scan and drops all cached topology when they differ, e.g.
+// after a hotplug. present must be in stable (sorted) order.
+func syncTopologyCache(present []string) {
+	fingerprint := strings.Join(present, ",")
+	topoMutex.Lock()
+	defer topoMutex.Unlock()
+	if fingerprint == topoLastSet {
+		return
+	}
+	topoCache = make(map[string]topologyInfo)
+	topoLastSet = fingerprint
+}
@@ -0,0 +1,117 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// plantCard builds a fake PCI hierarchy root/<bridge>/<bdf> with the
+// given numa_node and symlinks it under root/devices/<bdf>, mirroring
+// how /sys/bus/pci/devices points into /sys/devices.
+func plantCard(t *testing.T, root, bridge, bdf, numa string) string {
+	t.Helper()
+	real := path.Join(root, "tree", bridge, bdf)
+	if err := os.MkdirAll(real, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(real, NumaNodeFile), []byte(numa+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := path.Join(root, "devices", bdf)
+	if err := os.MkdirAll(path.Dir(link), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(link)
+	if err := os.Symlink(real, link); err != nil {
+		t.Fatal(err)
+	}
+	return link
+}
+
+func TestReadTopology(t *testing.T) {
+	root := t.TempDir()
+	link := plantCard(t, root, "0000:00:01.0", "0000:65:00.1", "1")
+
+	topo := readTopology(link)
+	if topo.NUMANode != 1 {
+		t.Errorf("NUMANode = %d, want 1", topo.NUMANode)
+	}
+	if topo.ParentSwitch != "0000:00:01.0" {
+		t.Errorf("ParentSwitch = %q, want 0000:00:01.0", topo.ParentSwitch)
+	}
+
+	// a card that moved behind another switch is picked up on re-read
+	link = plantCard(t, root, "0000:00:02.0", "0000:65:00.1", "0")
+	topo = readTopology(link)
+	if topo.NUMANode != 0 || topo.ParentSwitch != "0000:00:02.0" {
+		t.Errorf("after move got %+v, want NUMA 0 behind 0000:00:02.0", topo)
+	}
+
+	// sysfs -1 (no affinity) stays -1 instead of clamping to node 0
+	link = plantCard(t, root, "0000:00:03.0", "0000:af:00.1", "-1")
+	topo = readTopology(link)
+	if topo.NUMANode != -1 {
+		t.Errorf("numa_node -1 parsed as %d, want -1", topo.NUMANode)
+	}
+
+	// no numa_node file and no bridge parent degrade gracefully
+	bare := path.Join(root, "bare")
+	if err := os.MkdirAll(bare, 0755); err != nil {
+		t.Fatal(err)
+	}
+	topo = readTopology(bare)
+	if topo.NUMANode != -1 || topo.ParentSwitch != "" {
+		t.Errorf("bare dir got %+v, want unknown topology", topo)
+	}
+}
+
+func TestSyncTopologyCache(t *testing.T) {
+	topoMutex.Lock()
+	savedCache, savedSet := topoCache, topoLastSet
+	topoMutex.Unlock()
+	defer func() {
+		topoMutex.Lock()
+		topoCache, topoLastSet = savedCache, savedSet
+		topoMutex.Unlock()
+	}()
+
+	syncTopologyCache([]string{"0000:65:00.0", "0000:65:00.1"})
+	topoMutex.Lock()
+	topoCache["0000:65:00.1"] = topologyInfo{NUMANode: 0}
+	topoMutex.Unlock()
+
+	// same device set keeps the cache
+	syncTopologyCache([]string{"0000:65:00.0", "0000:65:00.1"})
+	topoMutex.Lock()
+	_, kept := topoCache["0000:65:00.1"]
+	topoMutex.Unlock()
+	if !kept {
+		t.Error("cache dropped although the device set did not change")
+	}
+
+	// a hotplugged card invalidates everything
+	syncTopologyCache([]string{"0000:65:00.0", "0000:65:00.1", "0000:d8:00.1"})
+	topoMutex.Lock()
+	_, kept = topoCache["0000:65:00.1"]
+	topoMutex.Unlock()
+	if kept {
+		t.Error("stale topology survived a device set change")
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// validator collects pass/fail results for the --validate preflight
+// mode. It packages the checks discovery performs silently (and a few
+// it doesn't) into an operator-facing report with remediation hints.
+type validator struct {
+	failures int
+}
+
+func (v *validator) pass(card, check string) {
+	fmt.Printf("PASS  %-14s %s\n", card, check)
+}
+
+func (v *validator) fail(card, check, hint string) {
+	v.failures++
+	fmt.Printf("FAIL  %-14s %s\n", card, check)
+	fmt.Printf("      %-14s hint: %s\n", "", hint)
+}
+
+// check reports ok as a pass and !ok as a failure with the hint.
+func (v *validator) check(ok bool, card, check, hint string) bool {
+	if ok {
+		v.pass(card, check)
+	} else {
+		v.fail(card, check, hint)
+	}
+	return ok
+}
+
+// validateCard runs the per-card sysfs checks for one recognized PCI
+// function.
+func (v *validator) validateCard(pciID, vendorID string) {
+	devDir := path.Join(SysfsDevices, pciID)
+
+	_, err := os.Stat(path.Join(devDir, "driver"))
+	v.check(err == nil, pciID, "driver bound",
+		"load the xocl (user PF) / xclmgmt (mgmt PF) driver and bind the device")
+
+	if !IsUserPf(pciID) {
+		return
+	}
+
+	content, err := GetFileContent(path.Join(devDir, ReadyFile))
+	if !v.check(err == nil, pciID, "ready attribute readable",
+		"update the XRT driver; old versions don't expose "+ReadyFile) {
+		return
+	}
+	v.check(strings.Compare(content, FPGAReady) == 0, pciID, "shell ready",
+		"flash or program the shell, then cold boot the host")
+
+	layout, err := resolveLayout(devDir, vendorID)
+	if !v.check(err == nil, pciID, "metadata layout recognized",
+		"this XRT release lays out sysfs differently; update the plugin") {
+		return
+	}
+	for _, probe := range []struct{ name, fname string }{
+		{"serial number readable", layout.serialPath},
+		{"shell version readable", layout.vbnvPath},
+		{"timestamp readable", layout.timestampPath},
+	} {
+		if probe.fname == "" {
+			// the layout marks attributes this driver never exposes,
+			// e.g. the Advantech build date, with an empty path
+			continue
+		}
+		_, err := GetFileContent(probe.fname)
+		v.check(err == nil, pciID, probe.name,
+			"check kernel logs for XMC/sensor errors on this card")
+	}
+}
+
+// validateNode checks that a discovered device node is present and
+// openable with the permissions the plugin will grant to pods.
+func (v *validator) validateNode(card, devNode string) {
+	if _, err := os.Stat(devNode); err != nil {
+		v.fail(card, "device node "+devNode+" present",
+			"reload the driver; the node should be created by udev")
+		return
+	}
+	v.pass(card, "device node "+devNode+" present")
+	f, err := os.OpenFile(devNode, os.O_RDWR, 0)
+	if v.check(err == nil, card, "device node "+devNode+" openable",
+		"run as root or fix the node's owner/mode via udev rules") {
+		f.Close()
+	}
+}
+
+// runValidation performs the full preflight battery and returns the
+// process exit code: 0 when everything passed, 1 otherwise.
+func runValidation() int {
+	v := &validator{}
+
+	pciFiles, err := ioutil.ReadDir(SysfsDevices)
+	if !v.check(err == nil, "node", "sysfs PCI tree readable",
+		"run on the host (or with /sys mounted into the container)") {
+		return 1
+	}
+
+	cards := 0
+	for _, pciFile := range pciFiles {
+		pciID := pciFile.Name()
+		vendorID, err := GetFileContent(path.Join(SysfsDevices, pciID, VendorFile))
+		if err != nil {
+			continue
+		}
+		if !isKnownVendor(vendorID) {
+			continue
+		}
+		// same skip as discovery: a bridge carrying the board vendor's
+		// ID is not a card
+		if isPCIBridge(path.Join(SysfsDevices, pciID)) {
+			continue
+		}
+		cards++
+		v.validateCard(pciID, vendorID)
+	}
+	v.check(cards > 0, "node", "FPGA devices present",
+		"no recognized vendor IDs on the PCI bus; check lspci and the device's seating")
+
+	devices, diags, err := ScanDevices()
+	for _, diag := range diags {
+		v.fail(diag.PciID, diag.Step,
+			"see the matching sysfs checks above for this card")
+	}
+	if v.check(err == nil, "node", "device discovery",
+		"see the failures above; discovery needs sysfs metadata") {
+		for sn, device := range devices {
+			for _, node := range device.Nodes {
+				if node.User != "" {
+					v.validateNode(sn, node.User)
+				}
+				for _, subdev := range node.SubdevNodes {
+					v.validateNode(sn, subdev)
+				}
+				if node.Qdma != "" {
+					v.validateNode(sn, node.Qdma)
+				}
+			}
+		}
+	}
+
+	if v.failures > 0 {
+		fmt.Printf("\n%d check(s) failed\n", v.failures)
+		return 1
+	}
+	fmt.Println("\nall checks passed")
+	return 0
+}
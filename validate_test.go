@@ -0,0 +1,146 @@
+// Copyright 2018-2020 Xilinx Corporation. All Rights Reserved.
+// Author: Brian Xu(brianx@xilinx.com)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// plantValidationCard builds a user PF fixture with a bound driver, the
+// shape validateCard expects a healthy card to have.
+func plantValidationCard(t *testing.T, root, bdf string) string {
+	t.Helper()
+	devDir := plantUserPF(t, root, bdf, "SN-A", "xilinx_u250_xdma_201830_2", "1561465320", FPGAReady)
+	if err := os.MkdirAll(path.Join(devDir, "driver"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return devDir
+}
+
+func TestValidateCard(t *testing.T) {
+	defer func() {
+		SysfsDevices = "/sys/bus/pci/devices"
+		locator = pciLocator{root: SysfsDevices}
+	}()
+
+	cases := []struct {
+		name         string
+		breakFixture func(t *testing.T, devDir string)
+		wantFailures int
+	}{
+		{"healthy card passes every check", nil, 0},
+		{"unbound driver", func(t *testing.T, devDir string) {
+			if err := os.RemoveAll(path.Join(devDir, "driver")); err != nil {
+				t.Fatal(err)
+			}
+		}, 1},
+		{"shell not ready", func(t *testing.T, devDir string) {
+			if err := ioutil.WriteFile(path.Join(devDir, ReadyFile), []byte("0x0\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, 1},
+		{"unreadable timestamp", func(t *testing.T, devDir string) {
+			if err := os.Remove(path.Join(devDir, "rom.u130", DSAtsFile)); err != nil {
+				t.Fatal(err)
+			}
+		}, 1},
+		{"no recognized layout", func(t *testing.T, devDir string) {
+			for _, dir := range []string{"xmc.u129", "rom.u130"} {
+				if err := os.RemoveAll(path.Join(devDir, dir)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}, 1},
+	}
+	for _, c := range cases {
+		root := t.TempDir()
+		devDir := plantValidationCard(t, root, "0000:65:00.1")
+		if c.breakFixture != nil {
+			c.breakFixture(t, devDir)
+		}
+		SysfsDevices = root
+		locator = pciLocator{root: root}
+
+		v := &validator{}
+		v.validateCard("0000:65:00.1", XilinxVendorID)
+		if v.failures != c.wantFailures {
+			t.Errorf("%s: %d failure(s), want %d", c.name, v.failures, c.wantFailures)
+		}
+	}
+}
+
+// A mgmt PF only gets the driver-bound check; the user PF metadata
+// checks don't apply to it.
+func TestValidateCardMgmtPf(t *testing.T) {
+	defer func() {
+		SysfsDevices = "/sys/bus/pci/devices"
+		locator = pciLocator{root: SysfsDevices}
+	}()
+	root := t.TempDir()
+	devDir := path.Join(root, "0000:65:00.0")
+	if err := os.MkdirAll(path.Join(devDir, "driver"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(devDir, MgmtFile), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	SysfsDevices = root
+	locator = pciLocator{root: root}
+
+	v := &validator{}
+	v.validateCard("0000:65:00.0", XilinxVendorID)
+	if v.failures != 0 {
+		t.Errorf("mgmt PF failed validation: %d failure(s)", v.failures)
+	}
+}
+
+func TestValidateNode(t *testing.T) {
+	dir := t.TempDir()
+
+	// a missing node is one failure (presence), openability is skipped
+	v := &validator{}
+	v.validateNode("SN-A", path.Join(dir, "renderD128"))
+	if v.failures != 1 {
+		t.Errorf("missing node: %d failure(s), want 1", v.failures)
+	}
+
+	// a present, openable node passes both checks
+	node := path.Join(dir, "renderD129")
+	if err := ioutil.WriteFile(node, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	v = &validator{}
+	v.validateNode("SN-A", node)
+	if v.failures != 0 {
+		t.Errorf("openable node: %d failure(s), want 0", v.failures)
+	}
+
+	// present but not openable fails the permission check only
+	if os.Geteuid() != 0 {
+		locked := path.Join(dir, "renderD130")
+		if err := ioutil.WriteFile(locked, nil, 0000); err != nil {
+			t.Fatal(err)
+		}
+		v = &validator{}
+		v.validateNode("SN-A", locked)
+		if v.failures != 1 {
+			t.Errorf("locked node: %d failure(s), want 1", v.failures)
+		}
+	}
+}